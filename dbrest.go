@@ -1,20 +1,33 @@
 package dbrest
 
 import (
+	"errors"
 	"flag"
+	"github.com/gorilla/mux"
 	"github.com/peter-mount/golib/kernel"
 	"github.com/peter-mount/golib/kernel/cron"
 	"github.com/peter-mount/golib/rest"
 	"github.com/peter-mount/postgresql-rest/openapi"
 	"gopkg.in/yaml.v3"
+	"log"
+	"net/http"
+	"os"
 	"path/filepath"
+	"sync"
 )
 
 type DBRest struct {
 	configFile *string
+	watch      *int
+	check      *bool
+	generate   *string
+	filename   string
 	config     *openapi.OpenAPI
 	cron       *cron.CronService
-	rest       *rest.Server
+	server     *Server
+	// mutex prevents concurrent reloads
+	mutex  sync.Mutex
+	reload *reloader
 }
 
 func (a *DBRest) Name() string {
@@ -23,6 +36,9 @@ func (a *DBRest) Name() string {
 
 func (a *DBRest) Init(k *kernel.Kernel) error {
 	a.configFile = flag.String("c", "", "The config file to use")
+	a.watch = flag.Int("watch", 0, "If >0 check the config files every n seconds and reload on change")
+	a.check = flag.Bool("check", false, "Verify the config against the database then exit")
+	a.generate = flag.String("generate", "", "Write a config for the annotated functions in a schema to stdout then exit")
 
 	service, err := k.AddService(&cron.CronService{})
 	if err != nil {
@@ -30,11 +46,11 @@ func (a *DBRest) Init(k *kernel.Kernel) error {
 	}
 	a.cron = (service).(*cron.CronService)
 
-	service, err = k.AddService(&rest.Server{})
+	service, err = k.AddService(&Server{})
 	if err != nil {
 		return err
 	}
-	a.rest = (service).(*rest.Server)
+	a.server = (service).(*Server)
 
 	return nil
 }
@@ -48,6 +64,7 @@ func (a *DBRest) PostInit() error {
 	if err != nil {
 		return err
 	}
+	a.filename = filename
 
 	a.config = openapi.NewOpenAPI()
 	err = a.config.Unmarshal(filename)
@@ -55,37 +72,84 @@ func (a *DBRest) PostInit() error {
 		return err
 	}
 
-	if a.config.Webserver != nil {
-		if a.config.Webserver.Port > 0 {
-			a.rest.Port = a.config.Webserver.Port
+	a.server.Config = a.config.Webserver
+
+	if *a.generate != "" {
+		if a.config.DB == nil {
+			return errors.New("generate requires db in the config")
+		}
+		api, err := a.config.DB.Generate(*a.generate)
+		if err != nil {
+			return err
+		}
+		b, err := yaml.Marshal(api)
+		if err != nil {
+			return err
 		}
+		_, _ = os.Stdout.Write(b)
+		os.Exit(0)
+	}
+
+	if *a.check {
+		a.config.VerifyMode = openapi.VerifyFail
+		_, err = a.buildRouter(a.config)
+		if err != nil {
+			return err
+		}
+		log.Println("Verification passed")
+		os.Exit(0)
 	}
 
 	return nil
 }
 
 func (a *DBRest) Start() error {
-
-	err := a.config.Start(a.rest)
+	router, err := a.buildRouter(a.config)
 	if err != nil {
 		return err
 	}
+	a.server.SetRouter(router)
+	a.config.StartBackground(a.cron)
 
-	if a.config.Webserver != nil && a.config.Webserver.ExposeOpenAPI != "" {
-		api := a.config.Publish()
+	a.reload = newReloader(a, *a.watch)
+	return nil
+}
+
+func (a *DBRest) Stop() {
+	if a.reload != nil {
+		a.reload.stop()
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.config.StopBackground()
+}
+
+// buildRouter creates a new router containing the api defined in a config
+func (a *DBRest) buildRouter(config *openapi.OpenAPI) (*mux.Router, error) {
+	router := a.server.NewRouter()
+
+	err := config.Start(router)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Webserver != nil && config.Webserver.ExposeOpenAPI != "" {
+		api := config.Publish()
 		b, err := yaml.Marshal(api)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		a.rest.Handle("/openapi.yaml", func(r *rest.Rest) error {
+		router.HandleFunc("/openapi.yaml", rest.Handler(func(r *rest.Rest) error {
 			r.ContentType("application/yaml").
 				CacheMaxAge(60).
 				Value(b)
 			return nil
-		})
+		}))
 
-		a.rest.Static("/", a.config.Webserver.ExposeOpenAPI)
+		router.PathPrefix("/").
+			Handler(http.FileServer(http.Dir(config.Webserver.ExposeOpenAPI)))
 	}
 
-	return nil
+	return router, nil
 }
@@ -3,7 +3,13 @@ module github.com/peter-mount/postgresql-rest
 go 1.12
 
 require (
+	github.com/gorilla/handlers v1.4.0
+	github.com/gorilla/mux v1.7.2
+	github.com/gorilla/websocket v1.4.2
 	github.com/lib/pq v1.1.1
 	github.com/peter-mount/golib v0.0.0-20190625143223-83f7f5a660b1
+	github.com/streadway/amqp v1.0.0
+	golang.org/x/net v0.0.0-20190613194153-d28f0bde5980
+	gopkg.in/robfig/cron.v2 v2.0.0-20150107220207-be2e0b0deed5
 	gopkg.in/yaml.v3 v3.0.0
 )
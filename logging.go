@@ -0,0 +1,40 @@
+package dbrest
+
+import (
+	"github.com/peter-mount/postgresql-rest/openapi"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// consoleLogger logs requests to the console in the same format as rest.ConsoleLogger.
+// We use this rather than rest.ConsoleLogger as its ResponseWriter does not support http.Hijacker,
+// which websockets require.
+func consoleLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		sw := &openapi.StatusWriter{ResponseWriter: w}
+
+		defer func() {
+			elapsed := time.Now().Sub(start).Seconds()
+			log.Printf("| %d | %s | %s | %v | %v | %.6fs | %s",
+				sw.Status, r.Method, r.Host, remoteAddr(r), r.URL, elapsed, w.Header().Get("X-Request-Id"))
+		}()
+
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// remoteAddr returns the address of the client, the first X-Forwarded-For entry if present
+func remoteAddr(r *http.Request) string {
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		// Syntax on MDN: X-Forwarded-For: <client>, <proxy1>, <proxy2>
+		return strings.TrimSpace(strings.Split(forwardedFor, ",")[0])
+	}
+
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return ip
+}
@@ -0,0 +1,128 @@
+package openapi
+
+import (
+	"errors"
+	"fmt"
+	"github.com/streadway/amqp"
+	"time"
+)
+
+// amqpPublisher publishes messages to an AMQP 0-9-1 broker such as RabbitMQ.
+//
+// Messages are persistent & published with publisher confirms, so a message is only considered delivered once the
+// broker has accepted & routed it. The connection is opened when first required and reopened after any error.
+type amqpPublisher struct {
+	url      string
+	timeout  time.Duration
+	conn     *amqp.Connection
+	channel  *amqp.Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+}
+
+// The interval between heartbeats so a dead connection is noticed
+const amqpHeartbeat = 10 * time.Second
+
+func (p *amqpPublisher) close() {
+	if p.conn != nil {
+		_ = p.conn.Close()
+		p.conn = nil
+		p.channel = nil
+	}
+}
+
+// publish publishes a message, waiting for the broker to confirm it
+func (p *amqpPublisher) publish(exchange, routingKey, messageId, contentType string, body []byte) error {
+	err := p.publishMessage(exchange, routingKey, messageId, contentType, body)
+	if err != nil {
+		p.close()
+	}
+	return err
+}
+
+func (p *amqpPublisher) publishMessage(exchange, routingKey, messageId, contentType string, body []byte) error {
+	if p.conn == nil {
+		err := p.connect()
+		if err != nil {
+			return err
+		}
+	}
+
+	// mandatory so unroutable messages are returned
+	err := p.channel.Publish(exchange, routingKey, true, false, amqp.Publishing{
+		ContentType:  contentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    messageId,
+		Body:         body,
+	})
+	if err != nil {
+		return err
+	}
+
+	timeout := time.NewTimer(p.timeout)
+	defer timeout.Stop()
+
+	// A returned message is followed by its confirm, so both can be ready at once
+	var returned error
+	for {
+		select {
+		case r := <-p.returns:
+			returned = p.returnedError(r, messageId, returned)
+
+		case c, ok := <-p.confirms:
+			if !ok {
+				return errors.New("amqp: channel closed")
+			}
+			if !c.Ack {
+				return errors.New("amqp: message rejected by the broker")
+			}
+
+			// Pick up a return that was ready alongside the confirm
+			for {
+				select {
+				case r := <-p.returns:
+					returned = p.returnedError(r, messageId, returned)
+				default:
+					return returned
+				}
+			}
+
+		case <-timeout.C:
+			return errors.New("amqp: timeout waiting for confirm")
+		}
+	}
+}
+
+// returnedError returns the error for a returned message if it's the one being published, ignoring any other
+func (p *amqpPublisher) returnedError(r amqp.Return, messageId string, err error) error {
+	if r.MessageId != messageId {
+		return err
+	}
+	return fmt.Errorf("amqp: message returned: %d %s", r.ReplyCode, r.ReplyText)
+}
+
+// connect opens the connection & a channel in confirm mode
+func (p *amqpPublisher) connect() error {
+	conn, err := amqp.DialConfig(p.url, amqp.Config{
+		Heartbeat: amqpHeartbeat,
+		Dial:      amqp.DefaultDial(p.timeout),
+	})
+	if err != nil {
+		return err
+	}
+
+	ch, err := conn.Channel()
+	if err == nil {
+		err = ch.Confirm(false)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	p.conn = conn
+	p.channel = ch
+	p.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	p.returns = ch.NotifyReturn(make(chan amqp.Return, 1))
+	return nil
+}
@@ -0,0 +1,41 @@
+package openapi
+
+import (
+	"github.com/peter-mount/golib/kernel/cron"
+)
+
+// StartBackground starts the services that run independently of requests: webhooks, the outbox, pollers, watchers &
+// the workers of async handlers.
+// They are started separately from Start so a config can be checked or replaced without them running twice.
+func (c *OpenAPI) StartBackground(cs *cron.CronService) {
+	if c.Webhooks != nil {
+		c.Webhooks.start()
+	}
+	if c.Outbox != nil {
+		c.Outbox.start()
+	}
+	c.startPollers(cs)
+	for _, w := range c.Watchers {
+		w.start()
+	}
+	if c.Jobs != nil {
+		c.Jobs.start()
+	}
+}
+
+// StopBackground stops the services started by StartBackground
+func (c *OpenAPI) StopBackground() {
+	if c.Webhooks != nil {
+		c.Webhooks.stop()
+	}
+	if c.Outbox != nil {
+		c.Outbox.stop()
+	}
+	c.stopPollers()
+	for _, w := range c.Watchers {
+		w.stop()
+	}
+	if c.Jobs != nil {
+		c.Jobs.stop()
+	}
+}
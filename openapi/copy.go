@@ -0,0 +1,360 @@
+package openapi
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/peter-mount/golib/rest"
+	"io"
+	"strings"
+)
+
+// Copy streams the request body into a table using COPY FROM STDIN.
+//
+// lib/pq only supports COPY with values supplied per row so the body is parsed here as it's read, never being held in
+// memory. If the handler also has a function then it's called once the rows have been copied within the same
+// transaction, e.g. to process a staging table. The response is the number of rows copied.
+type Copy struct {
+	// Table to copy into, optionally schema qualified
+	Table string `yaml:"table"`
+	// Columns to copy into, defaults to the header if present otherwise all columns of the table
+	Columns []string `yaml:"columns,omitempty"`
+	// Format of the body, "csv" (the default) or "tsv"
+	Format string `yaml:"format,omitempty"`
+	// Delimiter between csv fields, defaults to ,
+	Delimiter string `yaml:"delimiter,omitempty"`
+	// Header is true if the first row contains the column names
+	Header bool `yaml:"header,omitempty"`
+	// Null is the value treated as null, defaults to an empty field for csv and \N for tsv
+	Null *string `yaml:"null,omitempty"`
+	// MaxSize is the maximum body size in bytes, 0 for no limit
+	MaxSize int64 `yaml:"maxSize,omitempty"`
+	table   string
+	null    string
+}
+
+// recordReader reads a record from the body
+type recordReader func() ([]string, error)
+
+// compileCopy prepares a handler that copies the body into a table
+func (m *Method) compileCopy(params []string) error {
+	err := m.Handler.Copy.compile()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range m.Parameters {
+		if p.In == "body" {
+			return fmt.Errorf("copy reads the body so parameter %s cannot be in body", p.Name)
+		}
+	}
+
+	if m.Handler.Function != "" {
+		m.Handler.sql = "SELECT " + m.Handler.Function + "(" + strings.Join(params, ",") + ")"
+	}
+
+	// The body can only be read once so it can't be retried
+	m.Handler.txOptions.Transaction = true
+	m.Handler.txOptions.Retries = 0
+
+	return nil
+}
+
+// compile checks the table & format, applying the defaults
+func (c *Copy) compile() error {
+	if c.Table == "" {
+		return fmt.Errorf("copy requires a table")
+	}
+	c.table = quoteQualified(c.Table)
+
+	switch c.Format {
+	case "", "csv":
+		c.Format = "csv"
+		c.null = ""
+		if c.Delimiter == "" {
+			c.Delimiter = ","
+		}
+		if len([]rune(c.Delimiter)) != 1 {
+			return fmt.Errorf("copy delimiter must be a single character")
+		}
+	case "tsv":
+		c.null = "\\N"
+	default:
+		return fmt.Errorf("unsupported copy format \"%s\"", c.Format)
+	}
+	if c.Null != nil {
+		c.null = *c.Null
+	}
+
+	return nil
+}
+
+// records returns a recordReader for the format
+func (c *Copy) records(r io.Reader) recordReader {
+	if c.Format == "tsv" {
+		br := bufio.NewReader(r)
+		return func() ([]string, error) {
+			line, err := br.ReadString('\n')
+			if err == io.EOF && line != "" {
+				err = nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			return strings.Split(line, "\t"), nil
+		}
+	}
+
+	cr := csv.NewReader(r)
+	cr.Comma = []rune(c.Delimiter)[0]
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	return cr.Read
+}
+
+// unescape returns the value of a field, tsv fields using the backslash escapes of the COPY text format
+func (c *Copy) unescape(v string) string {
+	if c.Format != "tsv" || strings.IndexByte(v, '\\') < 0 {
+		return v
+	}
+
+	b := make([]byte, 0, len(v))
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' || i+1 == len(v) {
+			b = append(b, v[i])
+			continue
+		}
+
+		i++
+		switch ch := v[i]; ch {
+		case 'b':
+			b = append(b, '\b')
+		case 'f':
+			b = append(b, '\f')
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case 'v':
+			b = append(b, '\v')
+		case 'x':
+			// \xh or \xhh
+			n, j := 0, i+1
+			for ; j < len(v) && j < i+3 && isHexDigit(v[j]); j++ {
+				n = n*16 + hexValue(v[j])
+			}
+			if j == i+1 {
+				b = append(b, ch)
+			} else {
+				b = append(b, byte(n))
+				i = j - 1
+			}
+		default:
+			if ch >= '0' && ch <= '7' {
+				// \o, \oo or \ooo
+				n, j := 0, i
+				for ; j < len(v) && j < i+3 && v[j] >= '0' && v[j] <= '7'; j++ {
+					n = n*8 + int(v[j]-'0')
+				}
+				b = append(b, byte(n))
+				i = j - 1
+			} else {
+				b = append(b, ch)
+			}
+		}
+	}
+	return string(b)
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexValue(c byte) int {
+	switch {
+	case c >= 'a':
+		return int(c-'a') + 10
+	case c >= 'A':
+		return int(c-'A') + 10
+	default:
+		return int(c - '0')
+	}
+}
+
+// copyHandler copies the body into the table
+func (m *Method) copyHandler(r *rest.Rest) error {
+	c := m.Handler.Copy
+
+	args, err := m.extractArgs(r)
+	if err != nil {
+		return err
+	}
+
+	if c.MaxSize > 0 && r.Request().ContentLength > c.MaxSize {
+		return NewError(413, "body exceeds %d bytes", c.MaxSize)
+	}
+
+	body, err := r.BodyReader()
+	if err != nil {
+		return err
+	}
+	if c.MaxSize > 0 {
+		body = &maxSizeReader{r: body, n: c.MaxSize}
+	}
+
+	ctx, cancel := m.requestContext(r)
+	defer cancel()
+
+	var count int64
+	err = m.Handler.DB.Run(ctx, m.Handler.txOptions, func(q Queryer) error {
+		count, err = c.copyFrom(ctx, q, body)
+		if err != nil {
+			return err
+		}
+
+		if m.Handler.sql != "" {
+			_, err = q.ExecContext(ctx, m.Handler.sql, args...)
+		}
+		return err
+	})
+	if err != nil {
+		return WrapContextError(ctx, err)
+	}
+
+	r.Status(200).
+		ContentType(rest.APPLICATION_JSON).
+		Value(map[string]int64{"rows": count})
+
+	return nil
+}
+
+// copyFrom copies the records read from r into the table returning the number of rows copied
+func (c *Copy) copyFrom(ctx context.Context, q Queryer, r io.Reader) (int64, error) {
+	next := c.records(r)
+
+	columns := c.Columns
+	if c.Header {
+		header, err := next()
+		if err == io.EOF {
+			return 0, Error400("missing header")
+		}
+		if err != nil {
+			return 0, copyError(err, 1)
+		}
+		if len(columns) == 0 {
+			for _, h := range header {
+				columns = append(columns, c.unescape(h))
+			}
+		}
+	}
+
+	stmt := "COPY " + c.table
+	if len(columns) > 0 {
+		var quoted []string
+		for _, col := range columns {
+			quoted = append(quoted, pq.QuoteIdentifier(col))
+		}
+		stmt = stmt + " (" + strings.Join(quoted, ",") + ")"
+	}
+	stmt = stmt + " FROM STDIN"
+
+	s, err := q.PrepareContext(ctx, stmt)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+
+	line := 1
+	if c.Header {
+		line++
+	}
+
+	var count int64
+	var values []interface{}
+	for ; ; line++ {
+		record, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, copyError(err, line)
+		}
+
+		if len(columns) > 0 && len(record) != len(columns) {
+			return 0, Error400("line %d: expected %d fields, got %d", line, len(columns), len(record))
+		}
+
+		values = values[:0]
+		for _, v := range record {
+			if v == c.null {
+				values = append(values, nil)
+			} else {
+				values = append(values, c.unescape(v))
+			}
+		}
+
+		_, err = s.ExecContext(ctx, values...)
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	// Flush the copy to get any errors
+	_, err = s.ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// copyError converts an error reading the body into a response
+func copyError(err error, line int) error {
+	if _, ok := err.(*restError); ok {
+		return err
+	}
+	if pe, ok := err.(*csv.ParseError); ok {
+		return Error400("line %d: %s", pe.Line, pe.Err.Error())
+	}
+	return Error400("line %d: %s", line, err.Error())
+}
+
+// maxSizeReader fails with a 413 once more than n bytes have been read
+type maxSizeReader struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if m.n < 0 {
+		return 0, NewError(413, "body too large")
+	}
+	if int64(len(p)) > m.n+1 {
+		p = p[:m.n+1]
+	}
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	if m.n < 0 {
+		return 0, NewError(413, "body too large")
+	}
+	return n, err
+}
+
+func (m *maxSizeReader) Close() error {
+	return m.r.Close()
+}
+
+// quoteQualified quotes an optionally schema qualified name
+func quoteQualified(name string) string {
+	var parts []string
+	for _, p := range strings.Split(name, ".") {
+		parts = append(parts, pq.QuoteIdentifier(p))
+	}
+	return strings.Join(parts, ".")
+}
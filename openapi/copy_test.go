@@ -0,0 +1,37 @@
+package openapi
+
+import "testing"
+
+func TestCopyUnescape(t *testing.T) {
+	tsv := &Copy{Format: "tsv"}
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "plain", want: "plain"},
+		{in: `a\tb`, want: "a\tb"},
+		{in: `line\nbreak\r`, want: "line\nbreak\r"},
+		{in: `\b\f\v`, want: "\b\f\v"},
+		{in: `back\\slash`, want: `back\slash`},
+		{in: `\x41\x4a2`, want: "AJ2"},
+		{in: `\x4`, want: "\x04"},
+		{in: `\xg`, want: "xg"},
+		{in: `\101\60\0`, want: "A0\x00"},
+		{in: `\1012`, want: "A2"},
+		{in: `\q`, want: "q"},
+		{in: `trailing\`, want: `trailing\`},
+	}
+
+	for _, test := range tests {
+		if got := tsv.unescape(test.in); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.in, got, test.want)
+		}
+	}
+
+	// csv has no escapes
+	csv := &Copy{Format: "csv"}
+	if got := csv.unescape(`a\tb`); got != `a\tb` {
+		t.Errorf("csv: got %q", got)
+	}
+}
@@ -2,7 +2,11 @@ package openapi
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	_ "github.com/lib/pq"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -11,7 +15,16 @@ type DB struct {
 	MaxOpen     int    `yaml:"maxOpen"`
 	MaxIdle     int    `yaml:"maxIdle"`
 	MaxLifetime int    `yaml:"maxLifetime"`
+	// Replicas is an optional list of urls to read only replicas of this database
+	Replicas []string `yaml:"replicas,omitempty"`
+	// MaxLag is the maximum replication lag in seconds before a replica is not used, 0 for no limit
+	MaxLag int `yaml:"maxLag,omitempty"`
+	// HealthCheck is the interval in seconds between checking the replicas, defaults to 10
+	HealthCheck int `yaml:"healthCheck,omitempty"`
 	db          *sql.DB
+	replicas    *replicaSet
+	notify      *notifier
+	notifyMutex sync.Mutex
 }
 
 func (d *DB) Start() error {
@@ -19,12 +32,6 @@ func (d *DB) Start() error {
 		return nil
 	}
 
-	db, err := sql.Open("postgres", d.PostgresUri)
-	if err != nil {
-		return err
-	}
-	d.db = db
-
 	if d.MaxOpen < 0 {
 		d.MaxOpen = 1
 	}
@@ -35,23 +42,57 @@ func (d *DB) Start() error {
 		d.MaxIdle = d.MaxOpen
 	}
 
-	d.db.SetMaxOpenConns(d.MaxOpen)
-	d.db.SetMaxIdleConns(d.MaxIdle)
+	db, err := d.open(d.PostgresUri)
+	if err != nil {
+		return err
+	}
+	d.db = db
 
-	if d.MaxLifetime > 0 {
-		d.db.SetConnMaxLifetime(time.Second * time.Duration(d.MaxLifetime))
+	if len(d.Replicas) > 0 {
+		d.replicas, err = newReplicaSet(d)
+		if err != nil {
+			d.Stop()
+			return err
+		}
 	}
 
 	return nil
 }
 
+// open opens a pool to a database using our pool settings
+func (d *DB) open(uri string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(d.MaxOpen)
+	db.SetMaxIdleConns(d.MaxIdle)
+
+	if d.MaxLifetime > 0 {
+		db.SetConnMaxLifetime(time.Second * time.Duration(d.MaxLifetime))
+	}
+
+	return db, nil
+}
+
 func (d *DB) Stop() {
+	d.stopNotifier()
+	// replicas is left set as requests may still be using it
+	if d.replicas != nil {
+		d.replicas.stop()
+	}
 	if d.db != nil {
 		_ = d.db.Close()
 		d.db = nil
 	}
 }
 
+// HasReplicas returns true if this database has read only replicas
+func (d *DB) HasReplicas() bool {
+	return len(d.Replicas) > 0
+}
+
 func (d *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
 	r, e := d.db.Exec(query, args...)
 	return r, e
@@ -73,3 +114,148 @@ func (d *DB) Prepare(sql string) (*sql.Stmt, error) {
 func (d *DB) Begin() (*sql.Tx, error) {
 	return d.db.Begin()
 }
+
+// key returns a string unique to the connection settings so databases with identical settings can share a pool
+func (d *DB) key() string {
+	return fmt.Sprintf("%s|%d|%d|%d|%s|%d|%d",
+		d.PostgresUri, d.MaxOpen, d.MaxIdle, d.MaxLifetime,
+		strings.Join(d.Replicas, ","), d.MaxLag, d.HealthCheck)
+}
+
+// pool returns a started database with the same settings as db, reusing an existing one if present
+func (c *OpenAPI) pool(db *DB) (*DB, error) {
+	if db == nil {
+		return nil, nil
+	}
+
+	key := db.key()
+	if e, exists := c.pools[key]; exists {
+		return e, nil
+	}
+
+	err := db.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	c.pools[key] = db
+	return db, nil
+}
+
+// stopPools stops the pools started whilst loading the config
+func (c *OpenAPI) stopPools() {
+	for _, d := range c.pools {
+		d.Stop()
+	}
+	c.pools = make(map[string]*DB)
+}
+
+// namedDB returns the started database with a name in databases, the default db if name is ""
+func (c *OpenAPI) namedDB(name string) (*DB, error) {
+	db := c.DB
+	if name != "" {
+		var ok bool
+		db, ok = c.Databases[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown database \"%s\"", name)
+		}
+	}
+	if db == nil {
+		return nil, errors.New("no database defined")
+	}
+	return c.pool(db)
+}
+
+// UsedDatabases returns the unique databases used by this api
+func (c *OpenAPI) UsedDatabases() []*DB {
+	var dbs []*DB
+	seen := make(map[*DB]interface{})
+	add := func(d *DB) {
+		if _, exists := seen[d]; d != nil && !exists {
+			seen[d] = nil
+			dbs = append(dbs, d)
+		}
+	}
+
+	add(c.DB)
+	if c.Webhooks != nil {
+		add(c.Webhooks.db)
+	}
+	if c.Outbox != nil {
+		add(c.Outbox.db)
+	}
+	for _, p := range c.Pollers {
+		add(p.db)
+	}
+	for _, w := range c.Watchers {
+		add(w.db)
+	}
+	if c.Jobs != nil {
+		add(c.Jobs.db)
+	}
+	_ = c.ForEachPath(func(path, method string, m *Method) error {
+		if m.Handler != nil {
+			add(m.Handler.DB)
+		}
+		return nil
+	})
+
+	return dbs
+}
+
+// containsDB returns true if dbs contains d
+func containsDB(dbs []*DB, d *DB) bool {
+	for _, e := range dbs {
+		if e == d {
+			return true
+		}
+	}
+	return false
+}
+
+// ReuseDatabases replaces any database with one from a previous api with identical settings so that the existing
+// pool is kept rather than opening a new one.
+func (c *OpenAPI) ReuseDatabases(prev *OpenAPI) {
+	existing := make(map[string]*DB)
+	for _, d := range prev.UsedDatabases() {
+		existing[d.key()] = d
+	}
+
+	replace := func(d *DB) *DB {
+		if e, ok := existing[d.key()]; ok && e != d {
+			d.Stop()
+			return e
+		}
+		return d
+	}
+
+	if c.DB != nil {
+		c.DB = replace(c.DB)
+	}
+	if c.Webhooks != nil && c.Webhooks.db != nil {
+		c.Webhooks.db = replace(c.Webhooks.db)
+	}
+	if c.Outbox != nil && c.Outbox.db != nil {
+		c.Outbox.db = replace(c.Outbox.db)
+	}
+	for _, p := range c.Pollers {
+		if p.db != nil {
+			p.db = replace(p.db)
+		}
+	}
+	for _, w := range c.Watchers {
+		if w.db != nil {
+			w.db = replace(w.db)
+		}
+	}
+	if c.Jobs != nil && c.Jobs.db != nil {
+		c.Jobs.db = replace(c.Jobs.db)
+	}
+
+	_ = c.ForEachPath(func(path, method string, m *Method) error {
+		if m.Handler != nil && m.Handler.DB != nil {
+			m.Handler.DB = replace(m.Handler.DB)
+		}
+		return nil
+	})
+}
@@ -1,7 +1,9 @@
 package openapi
 
 import (
+	"context"
 	"fmt"
+	"github.com/lib/pq"
 	"github.com/peter-mount/golib/rest"
 	"log"
 	"strconv"
@@ -45,6 +47,10 @@ func Error500(m string, a ...interface{}) error {
 	return NewError(500, m, a...)
 }
 
+func Error504(m string, a ...interface{}) error {
+	return NewError(504, m, a...)
+}
+
 func WrapError(e error) error {
 	if a, ok := e.(*restError); ok {
 		return a
@@ -52,6 +58,24 @@ func WrapError(e error) error {
 	return Error500(e.Error())
 }
 
+// WrapContextError maps an error caused by the request context ending to a 504 on timeout or a 499 if the client
+// disconnected, otherwise it's the same as WrapError
+func WrapContextError(ctx context.Context, e error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return Error504("Timeout")
+	case context.Canceled:
+		return NewError(499, "Client closed request")
+	}
+
+	// statement_timeout was reached
+	if pe, ok := e.(*pq.Error); ok && pe.Code == "57014" {
+		return Error504("Timeout")
+	}
+
+	return WrapError(e)
+}
+
 // IsErrorSchema returns true if the schema defines our Error struct
 func (s *Schema) IsErrorSchema() bool {
 	if !(s != nil && s.Type == "object" && len(s.Properties) == 2) {
@@ -90,8 +114,8 @@ func (m *Method) isValidContentType(c string) bool {
 // compileHandler takes the default handler and wraps it with handlers to handle custom errors
 // if those response codes are defined in the schema
 func (m *Method) compileHandler() error {
-	// Start with the default handler
-	m.handler = m.defaultHandler
+	// Start with the handler for the type of call
+	m.handler = m.restHandler()
 
 	for status, content := range m.Responses {
 
@@ -0,0 +1,226 @@
+package openapi
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/peter-mount/golib/rest"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Events relays notifications from LISTEN channels to the client as Server-Sent Events.
+//
+// Channels may contain path parameters, e.g. train_{id}, so a client only receives the notifications it's interested
+// in. A single connection per database listens on behalf of all clients. The event id allows clients to reconnect
+// with Last-Event-ID and receive any recent notifications they missed, which is also how a client that falls behind
+// by more than its buffer recovers once it's been disconnected.
+//
+// If the handler has a function then it's called with the parameters before subscribing, the request being
+// forbidden if it returns null or false. As otherwise any client could subscribe to any channel, channels with
+// parameters require either a function or Allow.
+type Events struct {
+	// Channels to listen to
+	Channels []string `yaml:"channels"`
+	// Allow is a regular expression the value of each parameter in Channels must match, e.g. [0-9]+
+	Allow string `yaml:"allow,omitempty"`
+	// Heartbeat is the interval in seconds between comments sent to keep the connection open, defaults to 15
+	Heartbeat int `yaml:"heartbeat,omitempty"`
+	// Buffer is the number of notifications queued per client before it's disconnected, defaults to 64
+	Buffer int `yaml:"buffer,omitempty"`
+	allow  *regexp.Regexp
+}
+
+var channelParam = regexp.MustCompile("{([^}]+)}")
+
+// compile checks the channels & applies the defaults
+func (e *Events) compile(function string) error {
+	if len(e.Channels) == 0 {
+		return fmt.Errorf("no channels defined")
+	}
+	err := e.compileAllow(function)
+	if err != nil {
+		return err
+	}
+	if e.Heartbeat <= 0 {
+		e.Heartbeat = 15
+	}
+	if e.Buffer <= 0 {
+		e.Buffer = 64
+	}
+	return nil
+}
+
+// compileAllow compiles Allow, failing if the channels have parameters that are neither checked by it nor by the
+// handler's function
+func (e *Events) compileAllow(function string) error {
+	if e.Allow != "" {
+		re, err := regexp.Compile("^(?:" + e.Allow + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid allow: %s", err.Error())
+		}
+		e.allow = re
+	}
+
+	if e.allow == nil && function == "" {
+		for _, c := range e.Channels {
+			if channelParam.MatchString(c) {
+				return fmt.Errorf("channel %s has parameters so requires a function or allow", c)
+			}
+		}
+	}
+	return nil
+}
+
+// channels returns the channels for a request, replacing any parameters
+func (e *Events) channels(r *rest.Rest) ([]string, error) {
+	var channels []string
+	for _, c := range e.Channels {
+		var err error
+		c = channelParam.ReplaceAllStringFunc(c, func(s string) string {
+			v := r.Var(s[1 : len(s)-1])
+			if v == "" {
+				err = Error400("missing path %s", s[1:len(s)-1])
+			} else if e.allow != nil && !e.allow.MatchString(v) {
+				err = NewError(403, "Forbidden")
+			}
+			return v
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Postgres truncates identifiers to 63 bytes
+		if len(c) > 63 {
+			return nil, Error400("channel too long")
+		}
+		channels = append(channels, c)
+	}
+	return channels, nil
+}
+
+// compileEvents prepares a handler relaying notifications as Server-Sent Events
+func (m *Method) compileEvents(params []string) error {
+	err := m.Handler.Events.compile(m.Handler.Function)
+	if err != nil {
+		return err
+	}
+
+	m.compileAuthorise(params)
+	return nil
+}
+
+// compileAuthorise prepares the optional function authorising a subscription
+func (m *Method) compileAuthorise(params []string) {
+	if m.Handler.Function != "" {
+		m.Handler.sql = "SELECT " + m.Handler.Function + "(" + strings.Join(params, ",") + ")"
+	}
+}
+
+// authorise calls the function, if any, returning a 403 if it returns null or false
+func (m *Method) authorise(r *rest.Rest, args []interface{}) error {
+	if m.Handler.sql == "" {
+		return nil
+	}
+
+	ctx, cancel := m.requestContext(r)
+	defer cancel()
+
+	var result sql.NullString
+	err := m.Handler.DB.Run(ctx, m.Handler.txOptions, func(q Queryer) error {
+		return q.QueryRowContext(ctx, m.Handler.sql, args...).Scan(&result)
+	})
+	if err != nil {
+		return WrapContextError(ctx, err)
+	}
+
+	if !result.Valid || result.String == "false" || result.String == "f" {
+		return NewError(403, "Forbidden")
+	}
+	return nil
+}
+
+// eventsHandler streams notifications until the client disconnects
+func (m *Method) eventsHandler(r *rest.Rest) error {
+	e := m.Handler.Events
+
+	args, err := m.extractArgs(r)
+	if err != nil {
+		return err
+	}
+
+	channels, err := e.channels(r)
+	if err != nil {
+		return err
+	}
+
+	err = m.authorise(r, args)
+	if err != nil {
+		return err
+	}
+
+	lastId, _ := strconv.ParseInt(r.GetHeader("Last-Event-ID"), 10, 64)
+
+	n := m.Handler.DB.notifier()
+	sub, missed := n.subscribe(channels, e.Buffer, lastId)
+	defer n.unsubscribe(sub)
+
+	r.Status(200).
+		ContentType("text/event-stream").
+		AddHeader("Cache-Control", "no-cache").
+		AddHeader("X-Accel-Buffering", "no")
+
+	out := r.Writer()
+	flusher, _ := out.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	for _, ev := range missed {
+		if writeEvent(out, ev) != nil {
+			return nil
+		}
+	}
+	flush()
+
+	heartbeat := time.NewTicker(time.Duration(e.Heartbeat) * time.Second)
+	defer heartbeat.Stop()
+
+	// Not requestContext as the handler's timeout does not apply to the stream
+	done := r.Request().Context().Done()
+	for {
+		select {
+		case <-done:
+			return nil
+
+		case <-sub.dropped:
+			// The client will reconnect & catch up with Last-Event-ID
+			return nil
+
+		case ev := <-sub.events:
+			err = writeEvent(out, ev)
+
+		case <-heartbeat.C:
+			_, err = io.WriteString(out, ": heartbeat\n\n")
+		}
+
+		if err != nil {
+			return nil
+		}
+		flush()
+	}
+}
+
+// writeEvent writes a notification as an event
+func writeEvent(w io.Writer, ev notification) error {
+	s := fmt.Sprintf("id: %d\nevent: %s\n", ev.id, ev.channel)
+	for _, line := range strings.Split(ev.payload, "\n") {
+		s = s + "data: " + line + "\n"
+	}
+	_, err := io.WriteString(w, s+"\n")
+	return err
+}
@@ -0,0 +1,265 @@
+package openapi
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"github.com/peter-mount/golib/rest"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export streams the rows of a set returning function to the response as CSV.
+//
+// lib/pq does not support COPY TO STDOUT so the rows are read as they arrive from the server and encoded here,
+// so memory use does not depend on the size of the export. Values are written as COPY writes them, the types the
+// driver parses being formatted back into PostgreSQL's text output, e.g. t & f for booleans, with the default
+// DateStyle & bytea_output. Nulls are written as empty fields as COPY does.
+type Export struct {
+	// Filename in the Content-Disposition header, defaults to export.csv
+	Filename string `yaml:"filename,omitempty"`
+	// Delimiter between fields, defaults to ,
+	Delimiter string `yaml:"delimiter,omitempty"`
+	// Header includes the column names as the first row, defaults to true
+	Header *bool `yaml:"header,omitempty"`
+}
+
+// How often the csv is flushed to the client
+const exportFlushRows = 1000
+
+// streamStarted marks an error occurring once a streamed response has started so it can't be retried or reported
+type streamStarted struct {
+	err error
+}
+
+func (e *streamStarted) Error() string {
+	return e.err.Error()
+}
+
+// abortStream aborts the response if err occurred once it had started, so the client sees it's incomplete rather
+// than a truncated file
+func abortStream(err error) {
+	if started, ok := err.(*streamStarted); ok {
+		log.Println("Stream failed:", started.err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// compileExport prepares a handler exporting a set returning function
+func (m *Method) compileExport(params []string) error {
+	e := m.Handler.Export
+
+	if e.Filename == "" {
+		e.Filename = "export.csv"
+	}
+
+	if e.Delimiter == "" {
+		e.Delimiter = ","
+	}
+	if len([]rune(e.Delimiter)) != 1 {
+		return fmt.Errorf("export delimiter must be a single character")
+	}
+
+	if m.Handler.ContentType == "" {
+		m.Handler.ContentType = "text/csv"
+	}
+
+	m.Handler.sql = "SELECT * FROM " + m.Handler.Function + "(" + strings.Join(params, ",") + ") r"
+	return nil
+}
+
+// exportHandler streams the function's rows as csv
+func (m *Method) exportHandler(r *rest.Rest) error {
+	args, err := m.extractArgs(r)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := m.requestContext(r)
+	defer cancel()
+
+	e := m.Handler.Export
+
+	// Set once the response has started, after which an error such as the commit failing must abort it
+	started := false
+
+	err = m.Handler.DB.Run(ctx, m.Handler.txOptions, func(q Queryer) error {
+		rows, err := q.QueryContext(ctx, m.Handler.sql, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		columnTypes, err := rows.ColumnTypes()
+		if err != nil {
+			return err
+		}
+		columns := make([]string, len(columnTypes))
+		pgTypes := make([]string, len(columnTypes))
+		for i, ct := range columnTypes {
+			columns[i], pgTypes[i] = ct.Name(), ct.DatabaseTypeName()
+		}
+
+		// From here on the response has started
+		started = true
+		r.Status(200).
+			ContentType(m.contentType()).
+			AddHeader("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", e.Filename))
+		m.cacheControl(r)
+
+		out := r.Writer()
+		w := csv.NewWriter(out)
+		w.Comma = []rune(e.Delimiter)[0]
+
+		if e.Header == nil || *e.Header {
+			_ = w.Write(columns)
+		}
+
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		record := make([]string, len(columns))
+
+		n := 0
+		for rows.Next() {
+			err = rows.Scan(ptrs...)
+			if err != nil {
+				return &streamStarted{err: err}
+			}
+
+			for i, v := range values {
+				record[i] = csvValue(v, pgTypes[i])
+			}
+
+			err = w.Write(record)
+			if err != nil {
+				return &streamStarted{err: err}
+			}
+
+			n++
+			if n%exportFlushRows == 0 {
+				w.Flush()
+				if f, ok := out.(http.Flusher); ok {
+					f.Flush()
+				}
+			}
+		}
+
+		if err = rows.Err(); err != nil {
+			return &streamStarted{err: err}
+		}
+
+		w.Flush()
+		if err = w.Error(); err != nil {
+			return &streamStarted{err: err}
+		}
+		return nil
+	})
+
+	if _, ok := err.(*streamStarted); !ok && err != nil && started {
+		err = &streamStarted{err: err}
+	}
+	abortStream(err)
+	if err != nil {
+		return WrapContextError(ctx, err)
+	}
+
+	return nil
+}
+
+// csvValue formats a value returned by the driver for csv as PostgreSQL would
+func csvValue(v interface{}, pgType string) string {
+	switch b := v.(type) {
+	case nil:
+		return ""
+	case bool:
+		if b {
+			return "t"
+		}
+		return "f"
+	case []byte:
+		if pgType == "BYTEA" {
+			return "\\x" + hex.EncodeToString(b)
+		}
+		return string(b)
+	case float64:
+		return pgFloat(b, pgType)
+	case time.Time:
+		return pgTime(b, pgType)
+	default:
+		return fmt.Sprint(b)
+	}
+}
+
+// pgFloat formats a float as the shortest representation that reads back the same, using an exponent outside the
+// range PostgreSQL writes in full
+func pgFloat(f float64, pgType string) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+
+	bitSize, digits := 64, 15
+	if pgType == "FLOAT4" {
+		bitSize, digits = 32, 6
+	}
+
+	s := strconv.FormatFloat(f, 'e', -1, bitSize)
+	exp, _ := strconv.Atoi(s[strings.Index(s, "e")+1:])
+	if exp < -4 || exp >= digits {
+		return s
+	}
+	return strconv.FormatFloat(f, 'f', -1, bitSize)
+}
+
+// pgTime formats a date, time or timestamp in the ISO DateStyle
+func pgTime(t time.Time, pgType string) string {
+	switch pgType {
+	case "DATE":
+		return pgYear(t, t.Format("-01-02"))
+	case "TIME":
+		return t.Format("15:04:05.999999")
+	case "TIMETZ":
+		return t.Format("15:04:05.999999") + pgZone(t)
+	case "TIMESTAMP":
+		return pgYear(t, t.Format("-01-02 15:04:05.999999"))
+	default:
+		return pgYear(t, t.Format("-01-02 15:04:05.999999")+pgZone(t))
+	}
+}
+
+// pgYear prefixes the rest of a date with its year, PostgreSQL writing years before 1AD with BC
+func pgYear(t time.Time, rest string) string {
+	if y := t.Year(); y <= 0 {
+		return fmt.Sprintf("%04d%s BC", 1-y, rest)
+	}
+	return fmt.Sprintf("%04d%s", t.Year(), rest)
+}
+
+// pgZone formats the offset of a time from UTC, e.g. +01 or +05:30
+func pgZone(t time.Time) string {
+	_, offset := t.Zone()
+	sign := "+"
+	if offset < 0 {
+		sign, offset = "-", -offset
+	}
+
+	s := fmt.Sprintf("%s%02d", sign, offset/3600)
+	if offset%3600 != 0 {
+		s = s + fmt.Sprintf(":%02d", offset%3600/60)
+		if offset%60 != 0 {
+			s = s + fmt.Sprintf(":%02d", offset%60)
+		}
+	}
+	return s
+}
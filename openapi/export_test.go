@@ -0,0 +1,45 @@
+package openapi
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCsvValue(t *testing.T) {
+	ist := time.FixedZone("", 5*3600+1800)
+
+	tests := []struct {
+		value  interface{}
+		pgType string
+		want   string
+	}{
+		{value: nil, pgType: "TEXT", want: ""},
+		{value: "text", pgType: "TEXT", want: "text"},
+		{value: int64(-5), pgType: "INT4", want: "-5"},
+		{value: true, pgType: "BOOL", want: "t"},
+		{value: false, pgType: "BOOL", want: "f"},
+		{value: []byte{0x01, 0xab}, pgType: "BYTEA", want: `\x01ab`},
+		{value: []byte("1.50"), pgType: "NUMERIC", want: "1.50"},
+		{value: 0.1, pgType: "FLOAT8", want: "0.1"},
+		{value: 1234567.0, pgType: "FLOAT8", want: "1234567"},
+		{value: 1e15, pgType: "FLOAT8", want: "1e+15"},
+		{value: 1e-5, pgType: "FLOAT8", want: "1e-05"},
+		{value: 1234567.0, pgType: "FLOAT4", want: "1.234567e+06"},
+		{value: math.Inf(-1), pgType: "FLOAT8", want: "-Infinity"},
+		{value: math.NaN(), pgType: "FLOAT8", want: "NaN"},
+		{value: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), pgType: "DATE", want: "2020-01-02"},
+		{value: time.Date(0, 1, 2, 0, 0, 0, 0, time.UTC), pgType: "DATE", want: "0001-01-02 BC"},
+		{value: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), pgType: "TIMESTAMP", want: "2020-01-02 03:04:05"},
+		{value: time.Date(2020, 1, 2, 3, 4, 5, 120000000, time.UTC), pgType: "TIMESTAMPTZ", want: "2020-01-02 03:04:05.12+00"},
+		{value: time.Date(2020, 1, 2, 3, 4, 5, 0, ist), pgType: "TIMESTAMPTZ", want: "2020-01-02 03:04:05+05:30"},
+		{value: time.Date(0, 1, 1, 3, 4, 5, 0, time.UTC), pgType: "TIME", want: "03:04:05"},
+		{value: time.Date(0, 1, 1, 3, 4, 5, 0, time.FixedZone("", -7*3600)), pgType: "TIMETZ", want: "03:04:05-07"},
+	}
+
+	for _, test := range tests {
+		if got := csvValue(test.value, test.pgType); got != test.want {
+			t.Errorf("%s %v: got %q, want %q", test.pgType, test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package openapi
+
+import (
+	"fmt"
+	"github.com/lib/pq"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// pgGenerateFunction is a function read from pg_proc when generating a config
+type pgGenerateFunction struct {
+	name       string
+	argNames   []string
+	argModes   []string
+	argTypes   []string
+	argDefault []string
+	returnType string
+	returnsSet bool
+	kind       string
+	comment    string
+}
+
+// annotation is the result of parsing the comment of a function.
+//
+// The comment consists of an optional summary line, an optional description and annotations each on their own line:
+//
+// @path /example/{id} the path, required for the function to be included
+//
+// @method get the method, defaults to get
+//
+// @tags a,b the tags
+//
+// @maxAge 60 the cache age in seconds
+//
+// @contentType application/json overrides the content type derived from the return type
+//
+// @body name the argument which receives the request body
+//
+// @header name an argument which is taken from a request header
+type annotation struct {
+	path        string
+	method      string
+	tags        []string
+	maxAge      int
+	contentType string
+	summary     string
+	description string
+	body        string
+	headers     []string
+}
+
+// Generate creates an OpenAPI containing a path for each function in a schema that has been annotated in its comment.
+// The result has no db so it's intended to be imported from a root config.
+//
+// An argument with a constant default is optional, one defaulting to null being nullable. An argument defaulting to
+// an expression such as now() is required as the expression can't be passed as a value. Overloaded functions must
+// have a different @path or @method.
+func (d *DB) Generate(schema string) (*OpenAPI, error) {
+	fns, err := d.generateFunctions(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	api := NewOpenAPI()
+	api.Info = &Info{Title: schema, Version: "1.0.0"}
+
+	// The function already using each method & path
+	used := make(map[string]string)
+
+	for _, fn := range fns {
+		a, err := parseAnnotation(fn.comment)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %s", schema, fn.name, err.Error())
+		}
+		if a.path == "" {
+			continue
+		}
+
+		key := strings.ToUpper(a.method) + " " + a.path
+		if other, exists := used[key]; exists {
+			return nil, fmt.Errorf("%s.%s: %s already used by %s", schema, fn.name, key, other)
+		}
+		used[key] = schema + "." + fn.name + "(" + strings.Join(fn.argTypes, ",") + ")"
+
+		m, err := fn.method(schema, a)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %s", schema, fn.name, err.Error())
+		}
+		api.AddHandler(a.path, a.method, m)
+	}
+
+	return api, nil
+}
+
+func (d *DB) generateFunctions(schema string) ([]pgGenerateFunction, error) {
+	prokind, err := d.prokind()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := d.Query(
+		"SELECT p.proname, "+
+			"COALESCE(p.proargnames, '{}'::text[]), "+
+			"COALESCE(p.proargmodes::text[], '{}'::text[]), "+
+			"COALESCE(p.proallargtypes, p.proargtypes::oid[])::regtype[]::text[], "+
+			"ARRAY(SELECT COALESCE(pg_get_function_arg_default(p.oid, i), '') "+
+			"FROM generate_series(1, COALESCE(array_length(p.proallargtypes, 1), p.pronargs)) i), "+
+			"p.prorettype::regtype::text, p.proretset, "+prokind+", "+
+			"COALESCE(obj_description(p.oid, 'pg_proc'), '') "+
+			"FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace "+
+			"WHERE n.nspname = $1 AND "+prokind+" IN ('f', 'p') "+
+			"ORDER BY p.proname",
+		schema,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fns []pgGenerateFunction
+	for rows.Next() {
+		var fn pgGenerateFunction
+		var argNames, argModes, argTypes, argDefault pq.StringArray
+		err = rows.Scan(&fn.name, &argNames, &argModes, &argTypes, &argDefault,
+			&fn.returnType, &fn.returnsSet, &fn.kind, &fn.comment)
+		if err != nil {
+			return nil, err
+		}
+		fn.argNames, fn.argModes, fn.argTypes, fn.argDefault = argNames, argModes, argTypes, argDefault
+		fns = append(fns, fn)
+	}
+
+	return fns, rows.Err()
+}
+
+func parseAnnotation(comment string) (*annotation, error) {
+	a := &annotation{method: "get"}
+
+	var description []string
+	for _, line := range strings.Split(comment, "\n") {
+		line = strings.TrimSpace(line)
+
+		if !strings.HasPrefix(line, "@") {
+			if a.summary == "" {
+				a.summary = line
+			} else {
+				description = append(description, line)
+			}
+			continue
+		}
+
+		key, value := line[1:], ""
+		if i := strings.IndexAny(key, " \t"); i >= 0 {
+			key, value = key[:i], strings.TrimSpace(key[i+1:])
+		}
+
+		switch key {
+		case "path":
+			a.path = value
+		case "method":
+			a.method = strings.ToLower(value)
+			switch a.method {
+			case "get", "post", "put", "patch", "delete", "head", "options", "trace":
+			default:
+				return nil, fmt.Errorf("invalid @method \"%s\"", value)
+			}
+		case "tags":
+			for _, t := range strings.Split(value, ",") {
+				if t = strings.TrimSpace(t); t != "" {
+					a.tags = append(a.tags, t)
+				}
+			}
+		case "maxAge":
+			i, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid @maxAge \"%s\"", value)
+			}
+			a.maxAge = i
+		case "contentType":
+			a.contentType = value
+		case "body":
+			a.body = value
+		case "header":
+			a.headers = append(a.headers, value)
+		default:
+			return nil, fmt.Errorf("unknown annotation @%s", key)
+		}
+	}
+
+	a.description = strings.TrimSpace(strings.Join(description, "\n"))
+	return a, nil
+}
+
+// method creates the Method for an annotated function
+func (fn *pgGenerateFunction) method(schema string, a *annotation) (*Method, error) {
+	m := &Method{
+		Tags:        a.tags,
+		Summary:     a.summary,
+		Description: a.description,
+		Handler: &Handler{
+			MaxAge:      a.maxAge,
+			ContentType: a.contentType,
+			URLQuery:    true,
+		},
+		Responses: make(map[string]Response),
+	}
+
+	name := schema + "." + fn.name
+	if fn.kind == "p" {
+		m.Handler.Procedure = name
+	} else {
+		m.Handler.Function = name
+	}
+
+	for i, argType := range fn.argTypes {
+		mode := "i"
+		if i < len(fn.argModes) {
+			mode = fn.argModes[i]
+		}
+
+		argName := ""
+		if i < len(fn.argNames) {
+			argName = fn.argNames[i]
+		}
+
+		if mode == "o" || mode == "t" {
+			if fn.kind == "p" {
+				m.Handler.Out = append(m.Handler.Out, argName)
+			}
+			continue
+		}
+
+		if argName == "" {
+			return nil, fmt.Errorf("argument %d has no name", i+1)
+		}
+
+		p := &Parameter{}
+		p.Name = argName
+		p.Required = true
+		p.Schema.SchemaImpl = pgSchema(argType)
+
+		switch {
+		case argName == a.body:
+			p.In = "body"
+		case contains(a.headers, argName):
+			p.In = "header"
+		case strings.Contains(a.path, "{"+argName+"}"):
+			p.In = "path"
+		default:
+			p.In = "query"
+		}
+
+		if i < len(fn.argDefault) && fn.argDefault[i] != "" && p.In != "path" {
+			if v, ok := pgDefault(fn.argDefault[i]); ok {
+				p.Required = false
+				if v == nil {
+					p.Schema.Nullable = true
+				} else {
+					p.Schema.Default = v
+				}
+			}
+		}
+
+		m.Parameters = append(m.Parameters, p)
+	}
+
+	contentType := a.contentType
+	if contentType == "" {
+		contentType = pgContentType(fn.returnType)
+	}
+
+	ok := Response{}
+	ok.Description = "OK"
+	if fn.kind != "p" {
+		schema := &Schema{}
+		schema.SchemaImpl = pgSchema(fn.returnType)
+		ok.Content = map[string]ResponseEntry{contentType: {Schema: schema}}
+	}
+	m.Responses["200"] = ok
+
+	if fn.kind != "p" {
+		notFound := Response{}
+		notFound.Description = "Not found"
+		m.Responses["404"] = notFound
+	}
+
+	return m, nil
+}
+
+// pgSchema returns the schema for a postgres type
+func pgSchema(pgType string) SchemaImpl {
+	if strings.HasSuffix(pgType, "[]") {
+		items := &Schema{}
+		items.SchemaImpl = pgSchema(strings.TrimSuffix(pgType, "[]"))
+		return SchemaImpl{Type: "array", Items: items}
+	}
+
+	// Remove any type modifier, e.g. character varying(20)
+	if i := strings.Index(pgType, "("); i >= 0 {
+		pgType = pgType[:i]
+	}
+
+	switch pgType {
+	case "smallint", "integer":
+		return SchemaImpl{Type: "integer", Format: "int32"}
+	case "bigint":
+		return SchemaImpl{Type: "integer", Format: "int64"}
+	case "real":
+		return SchemaImpl{Type: "number", Format: "float"}
+	case "double precision":
+		return SchemaImpl{Type: "number", Format: "double"}
+	case "numeric":
+		return SchemaImpl{Type: "number"}
+	case "boolean":
+		return SchemaImpl{Type: "boolean"}
+	case "date":
+		return SchemaImpl{Type: "string", Format: "date"}
+	case "timestamp without time zone", "timestamp with time zone":
+		return SchemaImpl{Type: "string", Format: "date-time"}
+	case "uuid":
+		return SchemaImpl{Type: "string", Format: "uuid"}
+	case "bytea":
+		return SchemaImpl{Type: "string", Format: "byte"}
+	case "json", "jsonb":
+		return SchemaImpl{Type: "object"}
+	default:
+		return SchemaImpl{Type: "string"}
+	}
+}
+
+// pgContentType returns the content type for a function return type
+func pgContentType(pgType string) string {
+	switch pgType {
+	case "json", "jsonb":
+		return "application/json"
+	case "xml":
+		return "application/xml"
+	default:
+		return "text/plain"
+	}
+}
+
+// pgConstant matches a numeric or boolean constant
+var pgConstant = regexp.MustCompile(`^(-?[0-9]+(\.[0-9]+)?|true|false)$`)
+
+// pgCast matches any casts following a constant, e.g. ::character varying
+var pgCast = regexp.MustCompile(`^(::[A-Za-z_][A-Za-z0-9_ ."]*(\[])*)*$`)
+
+// pgDefault converts the sql expression of a default value into a value, e.g. 'abc'::text becomes abc and
+// NULL::text nil. It returns false if the default is not a constant, e.g. now().
+func pgDefault(expr string) (interface{}, bool) {
+	expr = strings.TrimSpace(expr)
+	for strings.HasPrefix(expr, "(") && strings.HasSuffix(expr, ")") {
+		expr = strings.TrimSpace(expr[1 : len(expr)-1])
+	}
+
+	if strings.HasPrefix(expr, "'") {
+		// Find the closing quote, '' being an escaped quote
+		var sb strings.Builder
+		i := 1
+		for ; i < len(expr); i++ {
+			if expr[i] == '\'' {
+				if i+1 < len(expr) && expr[i+1] == '\'' {
+					sb.WriteByte('\'')
+					i++
+					continue
+				}
+				break
+			}
+			sb.WriteByte(expr[i])
+		}
+		if i >= len(expr) || !pgCast.MatchString(expr[i+1:]) {
+			return nil, false
+		}
+		return sb.String(), true
+	}
+
+	if i := strings.Index(expr, "::"); i > 0 {
+		if !pgCast.MatchString(expr[i:]) {
+			return nil, false
+		}
+		expr = expr[:i]
+	}
+	if strings.ToUpper(expr) == "NULL" {
+		return nil, true
+	}
+	if pgConstant.MatchString(expr) {
+		return expr, true
+	}
+	return nil, false
+}
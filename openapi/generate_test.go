@@ -0,0 +1,35 @@
+package openapi
+
+import "testing"
+
+func TestPgDefault(t *testing.T) {
+	tests := []struct {
+		expr     string
+		want     interface{}
+		constant bool
+	}{
+		{expr: "'abc'::text", want: "abc", constant: true},
+		{expr: "'it''s'::character varying", want: "it's", constant: true},
+		{expr: "'a::b'", want: "a::b", constant: true},
+		{expr: "'{}'::integer[]", want: "{}", constant: true},
+		{expr: "42", want: "42", constant: true},
+		{expr: "3.5", want: "3.5", constant: true},
+		{expr: "'-1'::integer", want: "-1", constant: true},
+		{expr: "(-1)", want: "-1", constant: true},
+		{expr: "true", want: "true", constant: true},
+		{expr: "NULL", want: nil, constant: true},
+		{expr: "NULL::integer", want: nil, constant: true},
+		{expr: "now()"},
+		{expr: "CURRENT_USER"},
+		{expr: "nextval('seq'::regclass)"},
+		{expr: "'a'::text || 'b'::text"},
+		{expr: "'unterminated"},
+	}
+
+	for _, test := range tests {
+		got, constant := pgDefault(test.expr)
+		if constant != test.constant || got != test.want {
+			t.Errorf("%q: got %#v %v, want %#v %v", test.expr, got, constant, test.want, test.constant)
+		}
+	}
+}
@@ -1,11 +1,18 @@
 package openapi
 
 import (
+	"bufio"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/gorilla/mux"
 	"github.com/peter-mount/golib/rest"
 	"log"
+	"net"
+	"net/http"
 	"strings"
+	"time"
 )
 
 // Method represents the handler of a method
@@ -15,9 +22,12 @@ type Method struct {
 	Description   string              `yaml:"description,omitempty"`
 	Parameters    []*Parameter        `yaml:"parameters,omitempty"`
 	Handler       *Handler            `yaml:"handler,omitempty"`
+	RequestBody   *RequestBody        `yaml:"requestBody,omitempty"`
 	Responses     map[string]Response `yaml:"responses,omitempty"`
 	handler       rest.RestHandler    `yaml:"-"`
 	paramHandlers []paramHandler      `yaml:"-"`
+	// argParams are the parameters passed to the function, in the order of paramHandlers
+	argParams []*Parameter
 }
 
 type Parameter struct {
@@ -43,15 +53,65 @@ type ParameterImpl struct {
 	Deprecated      bool        `yaml:"deprecated,omitempty"`
 	Example         interface{} `yaml:"example,omitempty"`
 	Examples        interface{} `yaml:"examples,omitempty"`
+	// external is true if the parameter is only documented, the handler extracting it itself
+	external bool
+	// urlQuery is set from Handler.URLQuery
+	urlQuery bool
 }
 
 // Handler contains non-OpenAPI hander config used by dbrest to implement the API
 type Handler struct {
-	Function    string `yaml:"function"`
-	MaxAge      int    `yaml:"maxAge"`
-	ContentType string `yaml:"content-type"`
-	DB          *DB    `yaml:"-"`
+	Function string `yaml:"function"`
+	// Procedure is an alternative to Function which calls a stored procedure
+	Procedure string `yaml:"procedure,omitempty"`
+	// Out is the names of any OUT parameters of the procedure
+	Out         []string `yaml:"out,omitempty"`
+	MaxAge      int      `yaml:"maxAge"`
+	ContentType string   `yaml:"content-type"`
+	// Database is the name of an entry in databases to use instead of the default db
+	Database string `yaml:"db,omitempty"`
+	// ReadOnly runs the function in a READ ONLY transaction, on a replica if available.
+	// If not set then this defaults to true for get & head methods when the database has replicas.
+	ReadOnly *bool `yaml:"readOnly,omitempty"`
+	// Timeout in seconds before the call is cancelled, 0 to use the global timeout, <0 for none
+	Timeout int `yaml:"timeout,omitempty"`
+	// Isolation is the transaction isolation level: "read committed", "repeatable read" or "serializable"
+	Isolation string `yaml:"isolation,omitempty"`
+	// Deferrable makes a serializable read only transaction deferrable
+	Deferrable bool `yaml:"deferrable,omitempty"`
+	// Retries is the number of times to retry on a serialization failure or deadlock, defaults to 3, <0 for none
+	Retries int `yaml:"retries,omitempty"`
+	// Query enables the query language against the rows of a set returning function,
+	// the columns being those declared in the 200 response schema
+	Query bool `yaml:"query,omitempty"`
+	// Pagination pages the rows of a set returning function
+	Pagination *Pagination `yaml:"pagination,omitempty"`
+	// Export streams the rows of a set returning function as csv
+	Export *Export `yaml:"export,omitempty"`
+	// Copy streams the request body into a table
+	Copy *Copy `yaml:"copy,omitempty"`
+	// LargeObject streams the large object returned by the function
+	LargeObject *LargeObject `yaml:"largeObject,omitempty"`
+	// Events relays notifications as Server-Sent Events
+	Events *Events `yaml:"events,omitempty"`
+	// WebSocket relays notifications & messages over a WebSocket
+	WebSocket *WebSocket `yaml:"websocket,omitempty"`
+	// URLQuery takes query parameters from the url rather than the route, a missing query or header parameter
+	// falling back to the default in its schema. This is set on generated handlers.
+	URLQuery bool `yaml:"urlQuery,omitempty"`
+	// Async runs the function in the background, responding with 202 Accepted & the location of the job's status
+	Async bool `yaml:"async,omitempty"`
+	// MaxPartSize is the maximum size in bytes of a multipart form, file or largeobject part, defaults to 10MB.
+	// A maxLength in the parameter's schema overrides this.
+	MaxPartSize int64 `yaml:"maxPartSize,omitempty"`
+	DB          *DB   `yaml:"-"`
 	sql         string
+	txOptions   TxOptions
+	crud        *crudOp
+	columns     []string
+	skip        []string
+	jobs        *Jobs
+	jobKey      string
 }
 
 func (m *Method) Publish() *Method {
@@ -64,11 +124,12 @@ func (m *Method) Publish() *Method {
 		Parameters:  m.Parameters,
 		Summary:     m.Summary,
 		Tags:        m.Tags,
+		RequestBody: m.RequestBody,
 		Responses:   m.Responses,
 	}
 }
 
-func (m *Method) start(path, method string, server *rest.Server) error {
+func (m *Method) start(path, method string, router *mux.Router) error {
 	if m.Handler == nil {
 		return nil
 	}
@@ -83,9 +144,95 @@ func (m *Method) start(path, method string, server *rest.Server) error {
 		params = append(params, fmt.Sprintf("$%d", i+1))
 	}
 
-	m.Handler.sql = "SELECT " + m.Handler.Function + "(" + strings.Join(params, ",") + ")"
+	if m.Handler.ReadOnly != nil {
+		m.Handler.txOptions.ReadOnly = *m.Handler.ReadOnly
+	} else {
+		m.Handler.txOptions.ReadOnly = (method == "get" || method == "head") && m.Handler.DB.HasReplicas()
+	}
+
+	if m.Handler.Timeout > 0 {
+		m.Handler.txOptions.Timeout = time.Duration(m.Handler.Timeout) * time.Second
+	}
+
+	m.Handler.txOptions.Isolation, err = ParseIsolation(m.Handler.Isolation)
+	if err != nil {
+		return fmt.Errorf("%s %s: %s", method, path, err.Error())
+	}
+
+	m.Handler.txOptions.Deferrable = m.Handler.Deferrable
+
+	if m.Handler.Retries == 0 {
+		m.Handler.txOptions.Retries = 3
+	} else if m.Handler.Retries > 0 {
+		m.Handler.txOptions.Retries = m.Handler.Retries
+	}
+
+	switch {
+	case m.Handler.Function != "" && m.Handler.Procedure != "":
+		return fmt.Errorf("%s %s: function and procedure are mutually exclusive", method, path)
+
+	case len(m.handlerTypes()) > 1:
+		return fmt.Errorf("%s %s: %s are mutually exclusive", method, path, strings.Join(m.handlerTypes(), ", "))
+
+	case m.Handler.Async && (len(m.handlerTypes()) > 0 || m.Handler.crud != nil || m.Handler.Function == ""):
+		return fmt.Errorf("%s %s: async is only supported by function handlers", method, path)
+
+	case m.Handler.Procedure != "":
+		err = m.compileProcedure(params)
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", method, path, err.Error())
+		}
+
+	case m.Handler.crud != nil && m.Handler.crud.op != "list":
+		// The sql is generated per request
+
+	case m.Handler.Events != nil:
+		err = m.compileEvents(params)
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", method, path, err.Error())
+		}
+
+	case m.Handler.WebSocket != nil:
+		err = m.compileWebSocket(params)
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", method, path, err.Error())
+		}
+
+	case m.Handler.LargeObject != nil:
+		err = m.compileLargeObject(params)
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", method, path, err.Error())
+		}
 
-	server.Handle(path, m.handler).Methods(strings.ToUpper(method))
+	case m.isUpload():
+		err = m.compileUpload(params)
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", method, path, err.Error())
+		}
+
+	case m.Handler.Copy != nil:
+		err = m.compileCopy(params)
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", method, path, err.Error())
+		}
+
+	case m.Handler.Export != nil:
+		err = m.compileExport(params)
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", method, path, err.Error())
+		}
+
+	case m.Handler.Query || m.Handler.Pagination != nil:
+		err = m.compileQuery(params)
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", method, path, err.Error())
+		}
+
+	default:
+		m.Handler.sql = "SELECT " + m.Handler.Function + "(" + strings.Join(params, ",") + ")"
+	}
+
+	router.HandleFunc(path, handlerFunc(m.handler)).Methods(strings.ToUpper(method))
 
 	return nil
 }
@@ -97,12 +244,22 @@ func (m *Method) defaultHandler(r *rest.Rest) error {
 		return err
 	}
 
+	ctx, cancel := m.requestContext(r)
+	defer cancel()
+
 	var result sql.NullString
-	err = m.Handler.DB.QueryRow(m.Handler.sql, args...).Scan(&result)
+	err = m.Handler.DB.Run(ctx, m.Handler.txOptions, func(q Queryer) error {
+		return q.QueryRowContext(ctx, m.Handler.sql, args...).Scan(&result)
+	})
 	if err != nil {
-		return WrapError(err)
+		return WrapContextError(ctx, err)
 	}
 
+	return m.writeResult(r, result)
+}
+
+// writeResult writes the single value returned by a function to the response
+func (m *Method) writeResult(r *rest.Rest, result sql.NullString) error {
 	if result.Valid {
 		// As we are returning a single value then write that to the response as-is.
 		// If we use Value(result) then it will get escaped
@@ -113,29 +270,170 @@ func (m *Method) defaultHandler(r *rest.Rest) error {
 		return Error404("")
 	}
 
-	if m.Handler.ContentType != "" {
-		// Forced in handler definition
-		r.ContentType(m.Handler.ContentType)
-	} else {
-		// Look for first content type in the methods responses for "200"
-		if resp, ok := m.Responses["200"]; ok {
-			ct := ""
-			for c, _ := range resp.Content {
-				if ct == "" {
-					ct = c
-				}
+	if ct := m.contentType(); ct != "" {
+		r.ContentType(ct)
+	}
+
+	m.cacheControl(r)
+
+	return nil
+}
+
+// handlerFunc is the same as rest.Handler except the response is not sent if the handler has already streamed it
+// using rest.Writer() or hijacked the connection
+func handlerFunc(f rest.RestHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		sw := &StatusWriter{ResponseWriter: w}
+		r := rest.NewRest(sw, req)
+		r.SetAttribute(responseWriterAttribute, sw)
+
+		if err := f(r); err != nil {
+			log.Println(err)
+			if sw.Status == 0 {
+				w.WriteHeader(500)
 			}
-			if ct != "" {
-				r.ContentType(ct)
+		} else if sw.Status == 0 {
+			if err := r.Send(); err != nil {
+				log.Println(err)
 			}
 		}
 	}
+}
+
+// The rest attribute holding the underlying http.ResponseWriter
+const responseWriterAttribute = "dbrest.writer"
+
+// responseWriter returns the http.ResponseWriter of a request, for handlers that need more than rest.Writer()
+func responseWriter(r *rest.Rest) (http.ResponseWriter, bool) {
+	if a, ok := r.GetAttribute(responseWriterAttribute); ok {
+		w, ok := a.(http.ResponseWriter)
+		return w, ok
+	}
+	return nil, false
+}
+
+// StatusWriter records the status of a response whilst still supporting http.Flusher & http.Hijacker,
+// unlike rest.StatusCodeResponseWriter
+type StatusWriter struct {
+	http.ResponseWriter
+	// Status is the status sent, 0 if none yet
+	Status int
+}
+
+func (w *StatusWriter) WriteHeader(status int) {
+	if w.Status == 0 {
+		w.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *StatusWriter) Write(b []byte) (int, error) {
+	if w.Status == 0 {
+		w.Status = 200
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *StatusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *StatusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	conn, brw, err := h.Hijack()
+	if err == nil {
+		w.Status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+// restHandler returns the rest handler implementing the type of Handler configured
+func (m *Method) restHandler() rest.RestHandler {
+	switch {
+	case m.Handler.Procedure != "":
+		return m.procedureHandler
+	case m.Handler.crud != nil && m.Handler.crud.op != "list":
+		return m.crudHandler
+	case m.Handler.Events != nil:
+		return m.eventsHandler
+	case m.Handler.WebSocket != nil:
+		return m.webSocketHandler
+	case m.Handler.LargeObject != nil:
+		return m.largeObjectHandler
+	case m.isUpload():
+		return m.uploadHandler
+	case m.Handler.Copy != nil:
+		return m.copyHandler
+	case m.Handler.Export != nil:
+		return m.exportHandler
+	case m.Handler.Query || m.Handler.Pagination != nil:
+		return m.queryHandler
+	case m.Handler.Async:
+		return m.asyncHandler
+	default:
+		return m.defaultHandler
+	}
+}
+
+// handlerTypes returns the types of handler configured, only one of which is allowed
+func (m *Method) handlerTypes() []string {
+	var types []string
+	add := func(configured bool, t string) {
+		if configured {
+			types = append(types, t)
+		}
+	}
+	add(m.Handler.Procedure != "", "procedure")
+	add(m.Handler.Query || m.Handler.Pagination != nil, "query")
+	add(m.Handler.Export != nil, "export")
+	add(m.Handler.Copy != nil, "copy")
+	add(m.isUpload(), "multipart")
+	add(m.Handler.LargeObject != nil, "largeObject")
+	add(m.Handler.Events != nil, "events")
+	add(m.Handler.WebSocket != nil, "websocket")
+	return types
+}
+
+// returnsSet is true if the handler calls a set returning function
+func (h *Handler) returnsSet() bool {
+	return h.Query || h.Pagination != nil || h.Export != nil
+}
+
+// requestContext returns the context for a request, applying any timeout
+func (m *Method) requestContext(r *rest.Rest) (context.Context, context.CancelFunc) {
+	if m.Handler.Timeout > 0 {
+		return context.WithTimeout(r.Request().Context(), time.Duration(m.Handler.Timeout)*time.Second)
+	}
+	return context.WithCancel(r.Request().Context())
+}
+
+// contentType returns the response content type
+func (m *Method) contentType() string {
+	if m.Handler.ContentType != "" {
+		// Forced in handler definition
+		return m.Handler.ContentType
+	}
+
+	// Look for first content type in the methods responses for "200"
+	if resp, ok := m.Responses["200"]; ok {
+		for c, _ := range resp.Content {
+			return c
+		}
+	}
+
+	return ""
+}
 
+// cacheControl sets the Cache-Control header from MaxAge
+func (m *Method) cacheControl(r *rest.Rest) {
 	if m.Handler.MaxAge < 0 {
 		r.CacheNoCache()
 	} else if m.Handler.MaxAge > 0 {
 		r.CacheMaxAge(m.Handler.MaxAge)
 	}
-
-	return nil
 }
@@ -0,0 +1,106 @@
+package openapi
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// interpolate replaces any variables within the scalar values of a parsed yaml document.
+//
+// The following forms are supported:
+//
+// ${ENV_VAR} the value of an environment variable, failing if it's not defined.
+//
+// ${ENV_VAR:-default} the value of an environment variable or default if it's not defined or empty.
+//
+// ${file:/run/secrets/x} the content of a file, with any trailing newline removed.
+//
+// $${ is an escaped literal "${".
+func interpolate(filename string, node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode && strings.Contains(node.Value, "${") {
+		v, err := interpolateString(node.Value)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", filename, node.Line, err.Error())
+		}
+		node.Value = v
+
+		// Plain scalars need their tag resolving again so ${PORT} can be used for an int
+		if node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+			node.Tag = ""
+		}
+	}
+
+	for _, c := range node.Content {
+		err := interpolate(filename, c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func interpolateString(s string) (string, error) {
+	var sb strings.Builder
+
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			sb.WriteString(s)
+			return sb.String(), nil
+		}
+
+		// $${ is an escaped ${
+		if i > 0 && s[i-1] == '$' {
+			sb.WriteString(s[:i-1])
+			sb.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+
+		sb.WriteString(s[:i])
+		s = s[i+2:]
+
+		e := strings.Index(s, "}")
+		if e < 0 {
+			return "", fmt.Errorf("unterminated variable \"${%s\"", s)
+		}
+
+		v, err := interpolateVariable(s[:e])
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(v)
+		s = s[e+1:]
+	}
+}
+
+func interpolateVariable(name string) (string, error) {
+	if strings.HasPrefix(name, "file:") {
+		b, err := ioutil.ReadFile(name[5:])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+
+	def := ""
+	hasDefault := false
+	if i := strings.Index(name, ":-"); i >= 0 {
+		def = name[i+2:]
+		name = name[:i]
+		hasDefault = true
+	}
+
+	v, ok := os.LookupEnv(name)
+	if hasDefault && v == "" {
+		return def, nil
+	}
+	if !ok {
+		return "", fmt.Errorf("undefined variable \"%s\"", name)
+	}
+	return v, nil
+}
@@ -0,0 +1,60 @@
+package openapi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInterpolateString(t *testing.T) {
+	_ = os.Setenv("DBREST_TEST_HOST", "db.example.com")
+	_ = os.Setenv("DBREST_TEST_EMPTY", "")
+	_ = os.Unsetenv("DBREST_TEST_UNSET")
+	defer os.Unsetenv("DBREST_TEST_HOST")
+	defer os.Unsetenv("DBREST_TEST_EMPTY")
+
+	dir, err := ioutil.TempDir("", "interpolate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "secret")
+	if err = ioutil.WriteFile(secret, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{in: "plain", want: "plain"},
+		{in: "${DBREST_TEST_HOST}", want: "db.example.com"},
+		{in: "postgres://${DBREST_TEST_HOST}:5432/db", want: "postgres://db.example.com:5432/db"},
+		{in: "${DBREST_TEST_UNSET:-fallback}", want: "fallback"},
+		{in: "${DBREST_TEST_EMPTY:-fallback}", want: "fallback"},
+		{in: "${DBREST_TEST_HOST:-fallback}", want: "db.example.com"},
+		{in: "${DBREST_TEST_EMPTY}", want: ""},
+		{in: "$${DBREST_TEST_HOST}", want: "${DBREST_TEST_HOST}"},
+		{in: "${file:" + secret + "}", want: "s3cret"},
+		{in: "${DBREST_TEST_UNSET}", err: true},
+		{in: "${DBREST_TEST_HOST", err: true},
+		{in: "${file:" + filepath.Join(dir, "missing") + "}", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := interpolateString(test.in)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.in, err.Error())
+		} else if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.in, got, test.want)
+		}
+	}
+}
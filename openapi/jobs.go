@@ -0,0 +1,510 @@
+package openapi
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/peter-mount/golib/rest"
+	"log"
+	"sync"
+	"time"
+)
+
+// Jobs runs the calls of async handlers in the background.
+//
+// An async handler validates its parameters then queues the call, responding with 202 Accepted and a Location to the
+// status of the job at Path/{id}. The status includes the result once the job has succeeded, or the error if it
+// failed, until it expires.
+//
+// Statuses are kept in memory unless Table is set, which allows any instance to report them. The table must have the
+// columns:
+//
+//	CREATE TABLE jobs (
+//	    id       TEXT PRIMARY KEY,
+//	    status   TEXT NOT NULL, -- queued, running, succeeded or failed
+//	    result   TEXT,
+//	    error    TEXT,
+//	    created  TIMESTAMP WITH TIME ZONE NOT NULL,
+//	    started  TIMESTAMP WITH TIME ZONE,
+//	    finished TIMESTAMP WITH TIME ZONE,
+//	    expires  TIMESTAMP WITH TIME ZONE
+//	);
+//
+// The queue & workers are kept when the config is reloaded so jobs in progress are not lost, changes to Workers,
+// Queue, Table or Database requiring a restart. Queued jobs call the handler of the reloaded config, failing if it's
+// no longer async. Jobs still queued when dbrest stops are failed.
+type Jobs struct {
+	// Path of the job status endpoint, defaults to /jobs
+	Path string `yaml:"path,omitempty"`
+	// Workers is the number of jobs run at the same time, defaults to 4
+	Workers int `yaml:"workers,omitempty"`
+	// Queue is the number of jobs waiting for a worker before further requests are rejected, defaults to 100
+	Queue int `yaml:"queue,omitempty"`
+	// Expiry is the time in seconds a finished job's status is kept, defaults to 3600
+	Expiry int `yaml:"expiry,omitempty"`
+	// Table to keep the statuses in rather than memory
+	Table string `yaml:"table,omitempty"`
+	// Database is the name of an entry in databases to use for Table, defaults to db
+	Database string `yaml:"db,omitempty"`
+	db       *DB
+	runner   *jobRunner
+	// methods are the async handlers keyed by jobKey
+	methods map[string]*Method
+	// handedOver is set once a reloaded config has taken over the runner
+	handedOver bool
+}
+
+// Job statuses
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// job is a queued call
+type job struct {
+	id     string
+	key    string
+	args   []interface{}
+	status *jobStatus
+}
+
+// jobStatus is the status of a job as returned by the status endpoint
+type jobStatus struct {
+	Id       string      `json:"id"`
+	Status   string      `json:"status"`
+	Result   interface{} `json:"result,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Created  time.Time   `json:"created"`
+	Started  *time.Time  `json:"started,omitempty"`
+	Finished *time.Time  `json:"finished,omitempty"`
+	expires  time.Time
+}
+
+// jobRunner is the queue & workers running the jobs
+type jobRunner struct {
+	jobs   *Jobs
+	queue  chan *job
+	mutex  sync.Mutex
+	status map[string]*jobStatus
+	done   chan struct{}
+	// running is set once the workers have been started
+	running bool
+}
+
+// loadJobs checks the jobs config, creating it if any handler is async, & attaches it to the async handlers
+func (c *OpenAPI) loadJobs() error {
+	async := false
+	_ = c.ForEachPath(func(path, method string, m *Method) error {
+		async = async || (m.Handler != nil && m.Handler.Async)
+		return nil
+	})
+	if !async {
+		return nil
+	}
+
+	if c.Jobs == nil {
+		c.Jobs = &Jobs{}
+	}
+	j := c.Jobs
+
+	if j.Path == "" {
+		j.Path = "/jobs"
+	}
+	j.Path = addSlash(j.Path)
+	if j.Workers <= 0 {
+		j.Workers = 4
+	}
+	if j.Queue <= 0 {
+		j.Queue = 100
+	}
+	if j.Expiry <= 0 {
+		j.Expiry = 3600
+	}
+
+	if j.Table != "" {
+		db, err := c.namedDB(j.Database)
+		if err != nil {
+			return fmt.Errorf("jobs: %s", err.Error())
+		}
+		j.db = db
+	}
+
+	j.methods = make(map[string]*Method)
+	return c.ForEachPath(func(path, method string, m *Method) error {
+		if m.Handler != nil && m.Handler.Async {
+			m.Handler.jobs = j
+			m.Handler.jobKey = jobKey(path, method)
+			j.methods[m.Handler.jobKey] = m
+		}
+		return nil
+	})
+}
+
+// jobKey returns the key of an async handler so a queued job calls the handler of the current config
+func jobKey(path, method string) string {
+	return method + " " + path
+}
+
+// ReuseJobs takes over the job runner of a previous api so jobs in progress continue when the config is reloaded
+func (c *OpenAPI) ReuseJobs(prev *OpenAPI) {
+	if c.Jobs != nil && prev.Jobs != nil && prev.Jobs.runner != nil {
+		// The statuses already recorded would be lost
+		if c.Jobs.Table != prev.Jobs.Table || c.Jobs.db != prev.Jobs.db {
+			log.Printf("Jobs: table & db require a restart to change, keeping %q", prev.Jobs.Table)
+			dropped := c.Jobs.db
+			c.Jobs.Table, c.Jobs.db = prev.Jobs.Table, prev.Jobs.db
+
+			// Stop the pool opened for the new db unless something else is using it
+			if dropped != nil && !containsDB(c.UsedDatabases(), dropped) && !containsDB(prev.UsedDatabases(), dropped) {
+				dropped.Stop()
+			}
+		}
+
+		jr := prev.Jobs.runner
+		jr.mutex.Lock()
+		jr.jobs = c.Jobs
+		jr.mutex.Unlock()
+
+		c.Jobs.runner = jr
+		prev.Jobs.handedOver = true
+	}
+}
+
+// start starts the workers unless they have been taken over from a previous config
+func (j *Jobs) start() {
+	jr := j.runner
+	if jr == nil || jr.running {
+		return
+	}
+
+	jr.running = true
+	for i := 0; i < j.Workers; i++ {
+		go jr.worker()
+	}
+	go jr.expire()
+
+	log.Printf("Jobs: started %d workers", j.Workers)
+}
+
+// stop stops the workers, any jobs in progress completing & any still queued failing
+func (j *Jobs) stop() {
+	if j.runner == nil || j.handedOver {
+		return
+	}
+
+	jr := j.runner
+	close(jr.done)
+	for {
+		select {
+		case jb := <-jr.queue:
+			jr.fail(jb.status, "Job cancelled")
+		default:
+			return
+		}
+	}
+}
+
+// route registers the job status endpoint. The queue is created here, before the router can handle requests, with
+// the workers started by start.
+func (j *Jobs) route(router *mux.Router) {
+	if j.runner == nil {
+		j.runner = &jobRunner{
+			jobs:   j,
+			queue:  make(chan *job, j.Queue),
+			status: make(map[string]*jobStatus),
+			done:   make(chan struct{}),
+		}
+	}
+
+	router.HandleFunc(j.Path+"/{id}", handlerFunc(wrapAnyErrors(j.statusHandler))).Methods("GET")
+}
+
+// location returns the path of a job's status
+func (j *Jobs) location(id string) string {
+	return j.Path + "/" + id
+}
+
+// asyncHandler queues the call returning 202 Accepted
+func (m *Method) asyncHandler(r *rest.Rest) error {
+	args, err := m.extractArgs(r)
+	if err != nil {
+		return err
+	}
+
+	j := m.Handler.jobs
+	jr := j.runner
+	if jr == nil {
+		return NewError(503, "Jobs not running")
+	}
+
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return err
+	}
+
+	jb := &job{
+		id:   hex.EncodeToString(b),
+		key:  m.Handler.jobKey,
+		args: args,
+		status: &jobStatus{
+			Status:  jobQueued,
+			Created: time.Now(),
+		},
+	}
+	jb.status.Id = jb.id
+
+	err = jr.save(jb.status)
+	if err != nil {
+		return err
+	}
+
+	// The worker updates the status so respond with a copy
+	accepted := *jb.status
+
+	select {
+	case <-jr.done:
+		jr.fail(jb.status, "Jobs not running")
+		return NewError(503, "Jobs not running")
+	default:
+	}
+
+	select {
+	case jr.queue <- jb:
+	default:
+		jr.fail(jb.status, "Job queue full")
+
+		r.AddHeader("Retry-After", "10")
+		return NewError(503, "Job queue full")
+	}
+
+	r.Status(202).
+		AddHeader("Location", j.location(jb.id)).
+		ContentType(rest.APPLICATION_JSON).
+		Value(accepted)
+
+	return nil
+}
+
+// statusHandler returns the status of a job
+func (j *Jobs) statusHandler(r *rest.Rest) error {
+	jr := j.runner
+	if jr == nil {
+		return NewError(503, "Jobs not running")
+	}
+
+	s, err := jr.load(r.Var("id"))
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return Error404("")
+	}
+
+	if s.Status == jobQueued || s.Status == jobRunning {
+		r.AddHeader("Retry-After", "1")
+	}
+
+	r.Status(200).
+		AddHeader("Cache-Control", "no-cache").
+		ContentType(rest.APPLICATION_JSON).
+		Value(s)
+
+	return nil
+}
+
+// config returns the current config, which changes when the config is reloaded
+func (jr *jobRunner) config() *Jobs {
+	jr.mutex.Lock()
+	defer jr.mutex.Unlock()
+	return jr.jobs
+}
+
+func (jr *jobRunner) worker() {
+	for {
+		select {
+		case <-jr.done:
+			return
+		case jb := <-jr.queue:
+			jr.run(jb)
+		}
+	}
+}
+
+// run runs a job recording its outcome
+func (jr *jobRunner) run(jb *job) {
+	s := jb.status
+
+	// The config may have been reloaded since it was queued
+	m := jr.config().methods[jb.key]
+	if m == nil {
+		jr.fail(s, "Handler no longer async")
+		return
+	}
+
+	started := time.Now()
+	s.Status = jobRunning
+	s.Started = &started
+	jr.record(s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if m.Handler.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(m.Handler.Timeout)*time.Second)
+	}
+	defer cancel()
+
+	var result sql.NullString
+	err := m.Handler.DB.Run(ctx, m.Handler.txOptions, func(q Queryer) error {
+		return q.QueryRowContext(ctx, m.Handler.sql, jb.args...).Scan(&result)
+	})
+
+	finished := time.Now()
+	s.Finished = &finished
+	s.expires = finished.Add(time.Duration(jr.config().Expiry) * time.Second)
+
+	if err != nil {
+		log.Printf("Job %s: %s", jb.id, err.Error())
+		s.Status = jobFailed
+		s.Error = WrapContextError(ctx, err).Error()
+	} else {
+		s.Status = jobSucceeded
+		if result.Valid {
+			s.Result = result.String
+			if json.Valid([]byte(result.String)) {
+				s.Result = json.RawMessage(result.String)
+			}
+		}
+	}
+
+	jr.record(s)
+}
+
+// fail records a job that won't be run as failed
+func (jr *jobRunner) fail(s *jobStatus, msg string) {
+	finished := time.Now()
+	s.Status = jobFailed
+	s.Error = msg
+	s.Finished = &finished
+	s.expires = finished.Add(time.Duration(jr.config().Expiry) * time.Second)
+	jr.record(s)
+}
+
+// record saves a status logging any failure
+func (jr *jobRunner) record(s *jobStatus) {
+	if err := jr.save(s); err != nil {
+		log.Printf("Job %s: %s", s.Id, err.Error())
+	}
+}
+
+// save saves a copy of a status
+func (jr *jobRunner) save(s *jobStatus) error {
+	j := jr.config()
+	if j.Table == "" {
+		c := *s
+		jr.mutex.Lock()
+		jr.status[s.Id] = &c
+		jr.mutex.Unlock()
+		return nil
+	}
+
+	var result sql.NullString
+	switch v := s.Result.(type) {
+	case string:
+		result = sql.NullString{String: v, Valid: true}
+	case json.RawMessage:
+		result = sql.NullString{String: string(v), Valid: true}
+	}
+
+	var errMsg sql.NullString
+	if s.Error != "" {
+		errMsg = sql.NullString{String: s.Error, Valid: true}
+	}
+
+	var expires *time.Time
+	if !s.expires.IsZero() {
+		expires = &s.expires
+	}
+
+	_, err := j.db.Exec(
+		"INSERT INTO "+j.Table+" (id, status, result, error, created, started, finished, expires)"+
+			" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"+
+			" ON CONFLICT (id) DO UPDATE SET status = $2, result = $3, error = $4, started = $6, finished = $7, expires = $8",
+		s.Id, s.Status, result, errMsg, s.Created, s.Started, s.Finished, expires,
+	)
+	return err
+}
+
+// load returns the status of a job, nil if unknown or expired
+func (jr *jobRunner) load(id string) (*jobStatus, error) {
+	j := jr.config()
+	if j.Table == "" {
+		jr.mutex.Lock()
+		defer jr.mutex.Unlock()
+		s, ok := jr.status[id]
+		if !ok || (!s.expires.IsZero() && s.expires.Before(time.Now())) {
+			return nil, nil
+		}
+		c := *s
+		return &c, nil
+	}
+
+	s := &jobStatus{Id: id}
+	var result, errMsg sql.NullString
+	var started, finished *time.Time
+	err := j.db.QueryRow(
+		"SELECT status, result, error, created, started, finished FROM "+j.Table+
+			" WHERE id = $1 AND (expires IS NULL OR expires > now())",
+		id,
+	).Scan(&s.Status, &result, &errMsg, &s.Created, &started, &finished)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.Started, s.Finished, s.Error = started, finished, errMsg.String
+	if result.Valid {
+		s.Result = result.String
+		if json.Valid([]byte(result.String)) {
+			s.Result = json.RawMessage(result.String)
+		}
+	}
+	return s, nil
+}
+
+// expire periodically removes expired statuses
+func (jr *jobRunner) expire() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-jr.done:
+			return
+		case <-ticker.C:
+		}
+
+		j := jr.config()
+		if j.Table == "" {
+			now := time.Now()
+			jr.mutex.Lock()
+			for id, s := range jr.status {
+				if !s.expires.IsZero() && s.expires.Before(now) {
+					delete(jr.status, id)
+				}
+			}
+			jr.mutex.Unlock()
+		} else if res, err := j.db.Exec("DELETE FROM " + j.Table + " WHERE expires < now()"); err != nil {
+			log.Printf("Jobs: %s: %s", j.Table, err.Error())
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("Jobs: expired %d", n)
+		}
+	}
+}
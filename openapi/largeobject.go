@@ -0,0 +1,237 @@
+package openapi
+
+import (
+	"context"
+	"fmt"
+	"github.com/peter-mount/golib/rest"
+	"mime"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// LargeObject streams a large object returned by the function.
+//
+// The function returns either the OID of the large object or a row with the columns oid and optionally filename and
+// contenttype. The object is read in chunks within a transaction so it's never held in memory, and single byte
+// ranges are supported with the Range header.
+type LargeObject struct {
+	// ChunkSize is the size of each read, defaults to 256KB
+	ChunkSize int `yaml:"chunkSize,omitempty"`
+	// Inline serves the object with an inline Content-Disposition rather than attachment
+	Inline bool `yaml:"inline,omitempty"`
+}
+
+// Large object modes & whence from libpq-fs.h
+const (
+	loInvRead = 0x40000
+	loSeekSet = 0
+	loSeekEnd = 2
+)
+
+var byteRange = regexp.MustCompile("^bytes=([0-9]*)-([0-9]*)$")
+
+// compileLargeObject prepares a handler streaming a large object
+func (m *Method) compileLargeObject(params []string) error {
+	lo := m.Handler.LargeObject
+	if lo.ChunkSize <= 0 {
+		lo.ChunkSize = largeObjectChunkSize
+	}
+
+	m.Handler.sql = "SELECT * FROM " + m.Handler.Function + "(" + strings.Join(params, ",") + ") r"
+
+	// Large object descriptors only exist within a transaction
+	m.Handler.txOptions.Transaction = true
+
+	return nil
+}
+
+// largeObjectHandler streams the large object returned by the function
+func (m *Method) largeObjectHandler(r *rest.Rest) error {
+	args, err := m.extractArgs(r)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := m.requestContext(r)
+	defer cancel()
+
+	lo := m.Handler.LargeObject
+
+	err = m.Handler.DB.Run(ctx, m.Handler.txOptions, func(q Queryer) error {
+		oid, filename, contentType, err := m.largeObjectRow(ctx, q, args)
+		if err != nil {
+			return err
+		}
+
+		var fd int
+		err = q.QueryRowContext(ctx, "SELECT lo_open($1, $2)", oid, loInvRead).Scan(&fd)
+		if err != nil {
+			return err
+		}
+
+		var size int64
+		err = q.QueryRowContext(ctx, "SELECT lo_lseek64($1, 0, $2)", fd, loSeekEnd).Scan(&size)
+		if err != nil {
+			return err
+		}
+
+		start, end, partial, err := parseByteRange(r.GetHeader("Range"), size)
+		if err != nil {
+			r.AddHeader("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return err
+		}
+
+		_, err = q.ExecContext(ctx, "SELECT lo_lseek64($1, $2, $3)", fd, start, loSeekSet)
+		if err != nil {
+			return err
+		}
+
+		if contentType == "" {
+			contentType = m.contentType()
+		}
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		if filename != "" {
+			disposition := "attachment"
+			if lo.Inline {
+				disposition = "inline"
+			}
+			// Quoted & escaped as the name is from the database, nothing if it can't be
+			if v := mime.FormatMediaType(disposition, map[string]string{"filename": filename}); v != "" {
+				r.AddHeader("Content-Disposition", v)
+			}
+		}
+
+		status := 200
+		if partial {
+			status = 206
+			r.AddHeader("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		}
+
+		r.Status(status).
+			ContentType(contentType).
+			AddHeader("Accept-Ranges", "bytes").
+			AddHeader("Content-Length", strconv.FormatInt(end-start+1, 10))
+		m.cacheControl(r)
+
+		// From here on the response has started
+		out := r.Writer()
+		for remaining := end - start + 1; remaining > 0; {
+			n := int64(lo.ChunkSize)
+			if n > remaining {
+				n = remaining
+			}
+
+			var chunk []byte
+			err = q.QueryRowContext(ctx, "SELECT loread($1, $2)", fd, n).Scan(&chunk)
+			if err != nil {
+				return &streamStarted{err: err}
+			}
+			if len(chunk) == 0 {
+				return &streamStarted{err: fmt.Errorf("large object %d truncated", oid)}
+			}
+
+			_, err = out.Write(chunk)
+			if err != nil {
+				return &streamStarted{err: err}
+			}
+			remaining -= int64(len(chunk))
+		}
+
+		return nil
+	})
+	abortStream(err)
+	if err != nil {
+		return WrapContextError(ctx, err)
+	}
+
+	return nil
+}
+
+// largeObjectRow calls the function returning the oid, filename & content type
+func (m *Method) largeObjectRow(ctx context.Context, q Queryer, args []interface{}) (uint32, string, string, error) {
+	rows, err := q.QueryContext(ctx, m.Handler.sql, args...)
+	if err != nil {
+		return 0, "", "", err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return 0, "", "", err
+		}
+		return 0, "", "", Error404("")
+	}
+
+	row, err := scanRow(rows)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	// A function returning just an oid has a single column named after the function
+	oid := row["oid"]
+	if len(columns) == 1 {
+		oid = row[columns[0]]
+	}
+	if oid == nil {
+		return 0, "", "", Error404("")
+	}
+
+	id, err := strconv.ParseUint(fmt.Sprint(oid), 10, 32)
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	var filename, contentType string
+	if v := row["filename"]; v != nil {
+		filename = fmt.Sprint(v)
+	}
+	if v := row["contenttype"]; v != nil {
+		contentType = fmt.Sprint(v)
+	}
+
+	return uint32(id), filename, contentType, rows.Close()
+}
+
+// parseByteRange parses a Range header returning the inclusive start & end and if it's a partial response.
+// Multiple ranges are not supported so are served as the full content.
+func parseByteRange(h string, size int64) (int64, int64, bool, error) {
+	match := byteRange.FindStringSubmatch(h)
+	if match == nil || (match[1] == "" && match[2] == "") {
+		return 0, size - 1, false, nil
+	}
+
+	var start, end int64
+	switch {
+	case match[1] == "":
+		// Suffix, the last n bytes
+		n, _ := strconv.ParseInt(match[2], 10, 64)
+		if n > size {
+			n = size
+		}
+		start, end = size-n, size-1
+	default:
+		start, _ = strconv.ParseInt(match[1], 10, 64)
+		end = size - 1
+		if match[2] != "" {
+			end, _ = strconv.ParseInt(match[2], 10, 64)
+			if end >= size {
+				end = size - 1
+			}
+		}
+	}
+
+	if start >= size || start > end {
+		return 0, 0, false, NewError(416, "Range not satisfiable")
+	}
+
+	return start, end, true, nil
+}
@@ -0,0 +1,44 @@
+package openapi
+
+import "testing"
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		header  string
+		size    int64
+		start   int64
+		end     int64
+		partial bool
+		status  int
+	}{
+		{header: "", size: 100, start: 0, end: 99},
+		{header: "bytes=0-9", size: 100, start: 0, end: 9, partial: true},
+		{header: "bytes=90-", size: 100, start: 90, end: 99, partial: true},
+		{header: "bytes=-10", size: 100, start: 90, end: 99, partial: true},
+		{header: "bytes=-200", size: 100, start: 0, end: 99, partial: true},
+		{header: "bytes=50-500", size: 100, start: 50, end: 99, partial: true},
+		{header: "bytes=0-1,5-6", size: 100, start: 0, end: 99},
+		{header: "bytes=-", size: 100, start: 0, end: 99},
+		{header: "items=0-9", size: 100, start: 0, end: 99},
+		{header: "bytes=100-", size: 100, status: 416},
+		{header: "bytes=20-10", size: 100, status: 416},
+	}
+
+	for _, test := range tests {
+		start, end, partial, err := parseByteRange(test.header, test.size)
+		if test.status != 0 {
+			if e, ok := err.(*restError); !ok || e.Status != test.status {
+				t.Errorf("%q: got %v, want status %d", test.header, err, test.status)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.header, err.Error())
+			continue
+		}
+		if start != test.start || end != test.end || partial != test.partial {
+			t.Errorf("%q: got %d-%d %v, want %d-%d %v",
+				test.header, start, end, partial, test.start, test.end, test.partial)
+		}
+	}
+}
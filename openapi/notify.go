@@ -0,0 +1,229 @@
+package openapi
+
+import (
+	"github.com/lib/pq"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// notifier shares a single LISTEN connection to a database between all subscribers of its channels.
+//
+// Each notification is given an id, increasing across restarts, and the most recent are kept per channel so a client
+// that reconnects can be sent the ones it missed.
+//
+// Listen & Unlisten block until the server responds so they are never called whilst holding mutex, otherwise run()
+// could block the listener's connection. listenMutex orders them instead.
+type notifier struct {
+	mutex       sync.Mutex
+	listenMutex sync.Mutex
+	listener    *pq.Listener
+	channels    map[string]*notifyChannel
+	seq         int64
+	done        chan struct{}
+}
+
+type notifyChannel struct {
+	subscribers map[*subscription]bool
+	recent      []notification
+}
+
+// notification is a NOTIFY received on a channel
+type notification struct {
+	id      int64
+	channel string
+	payload string
+}
+
+// subscription receives the notifications of one or more channels.
+// If the client falls behind by more than its buffer then it's dropped and dropped is closed.
+type subscription struct {
+	channels []string
+	events   chan notification
+	dropped  chan struct{}
+}
+
+// The number of recent notifications kept per channel for Last-Event-ID
+const notifyReplaySize = 100
+
+// How long a channel is listened to after its last subscriber has gone so reconnecting clients don't miss anything
+const notifyLinger = time.Minute
+
+// notifier returns the shared notifier for this database, starting it if required
+func (d *DB) notifier() *notifier {
+	d.notifyMutex.Lock()
+	defer d.notifyMutex.Unlock()
+
+	if d.notify == nil {
+		n := &notifier{
+			channels: make(map[string]*notifyChannel),
+			seq:      time.Now().UnixNano() / int64(time.Millisecond) * 1000,
+			done:     make(chan struct{}),
+		}
+		n.listener = pq.NewListener(d.PostgresUri, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Println("Notify listener:", err)
+			}
+		})
+		go n.run()
+		d.notify = n
+	}
+	return d.notify
+}
+
+// stopNotifier closes the shared listener, if any
+func (d *DB) stopNotifier() {
+	d.notifyMutex.Lock()
+	defer d.notifyMutex.Unlock()
+
+	if d.notify != nil {
+		close(d.notify.done)
+		_ = d.notify.listener.Close()
+		d.notify = nil
+	}
+}
+
+func (n *notifier) run() {
+	for {
+		select {
+		case <-n.done:
+			return
+		case ev, ok := <-n.listener.Notify:
+			if !ok {
+				return
+			}
+			// nil is sent when the connection has been re-established
+			if ev != nil {
+				n.dispatch(ev.Channel, ev.Extra)
+			}
+		}
+	}
+}
+
+// dispatch sends a notification to every subscriber of a channel
+func (n *notifier) dispatch(channel, payload string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	c, ok := n.channels[channel]
+	if !ok {
+		return
+	}
+
+	n.seq++
+	ev := notification{id: n.seq, channel: channel, payload: payload}
+
+	c.recent = append(c.recent, ev)
+	if len(c.recent) > notifyReplaySize {
+		c.recent = c.recent[1:]
+	}
+
+	for s := range c.subscribers {
+		select {
+		case s.events <- ev:
+		default:
+			// Backpressure, the client has fallen too far behind so drop it rather than block everyone else
+			n.remove(s)
+			close(s.dropped)
+		}
+	}
+}
+
+// subscribe subscribes to channels. Any recent notifications with an id after lastId are returned so they can be
+// sent before those received by the subscription.
+func (n *notifier) subscribe(channels []string, buffer int, lastId int64) (*subscription, []notification) {
+	n.listenMutex.Lock()
+	defer n.listenMutex.Unlock()
+
+	s := &subscription{
+		channels: channels,
+		events:   make(chan notification, buffer),
+		dropped:  make(chan struct{}),
+	}
+
+	var missed []notification
+	var listen []string
+
+	n.mutex.Lock()
+	for _, channel := range channels {
+		c, ok := n.channels[channel]
+		if !ok {
+			c = &notifyChannel{subscribers: make(map[*subscription]bool)}
+			n.channels[channel] = c
+			listen = append(listen, channel)
+		}
+		c.subscribers[s] = true
+
+		if lastId > 0 {
+			for _, ev := range c.recent {
+				if ev.id > lastId {
+					missed = append(missed, ev)
+				}
+			}
+		}
+	}
+	n.mutex.Unlock()
+
+	sort.Slice(missed, func(i, j int) bool {
+		return missed[i].id < missed[j].id
+	})
+
+	for _, channel := range listen {
+		err := n.listener.Listen(channel)
+		if err != nil && err != pq.ErrChannelAlreadyOpen {
+			// Keep going, the listener will listen once it reconnects
+			log.Println("Notify listener:", err)
+		}
+	}
+
+	return s, missed
+}
+
+// unsubscribe removes a subscription
+func (n *notifier) unsubscribe(s *subscription) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.remove(s)
+}
+
+// remove removes a subscription, unlistening to any channels left without subscribers once notifyLinger has passed
+func (n *notifier) remove(s *subscription) {
+	for _, channel := range s.channels {
+		if c, ok := n.channels[channel]; ok {
+			delete(c.subscribers, s)
+			if len(c.subscribers) == 0 {
+				channel := channel
+				time.AfterFunc(notifyLinger, func() {
+					n.unlisten(channel)
+				})
+			}
+		}
+	}
+}
+
+// unlisten stops listening to a channel if it still has no subscribers
+func (n *notifier) unlisten(channel string) {
+	n.listenMutex.Lock()
+	defer n.listenMutex.Unlock()
+
+	n.mutex.Lock()
+	c, ok := n.channels[channel]
+	unused := ok && len(c.subscribers) == 0
+	if unused {
+		delete(n.channels, channel)
+	}
+	n.mutex.Unlock()
+
+	select {
+	case <-n.done:
+		// Closed
+	default:
+		if unused {
+			err := n.listener.Unlisten(channel)
+			if err != nil && err != pq.ErrChannelNotOpen {
+				log.Println("Notify listener:", err)
+			}
+		}
+	}
+}
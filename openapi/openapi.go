@@ -2,6 +2,9 @@ package openapi
 
 import (
 	"errors"
+	"fmt"
+	"github.com/peter-mount/golib/kernel/cron"
+	crn "gopkg.in/robfig/cron.v2"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
 	"log"
@@ -19,11 +22,27 @@ type OpenAPI struct {
 	//ExternalDocs []ExternalDocumentation `yaml:"externalDocs,omitempty"`
 
 	// Non standard, specific to dbrest
-	Prefix    string            `yaml:"-"`
-	Webserver *Webserver        `yaml:"webserver,omitempty"`
-	DB        *DB               `yaml:"db,omitempty"`
-	Imports   map[string]string `yaml:"import,omitempty"`
-	children  []*OpenAPI
+	Prefix    string              `yaml:"-"`
+	Webserver *Webserver          `yaml:"webserver,omitempty"`
+	DB        *DB                 `yaml:"db,omitempty"`
+	Databases map[string]*DB      `yaml:"databases,omitempty"`
+	Routes    *Routes             `yaml:"routes,omitempty"`
+	Webhooks  *Webhooks           `yaml:"webhooks,omitempty"`
+	Outbox    *Outbox             `yaml:"outbox,omitempty"`
+	Pollers   map[string]*Poller  `yaml:"pollers,omitempty"`
+	Watchers  map[string]*Watcher `yaml:"watchers,omitempty"`
+	Jobs      *Jobs               `yaml:"jobs,omitempty"`
+	Imports   map[string]string   `yaml:"import,omitempty"`
+	// Timeout is the default timeout in seconds for handlers, 0 for none
+	Timeout int `yaml:"timeout,omitempty"`
+	// VerifyMode is how to verify the handlers against the database on startup: "off", "warn" (the default) or "fail"
+	VerifyMode  string `yaml:"verify,omitempty"`
+	children    []*OpenAPI
+	files       []string
+	cron        *cron.CronService
+	cronEntries []crn.EntryID
+	// pools contains the started databases keyed by their settings so identical databases share a pool
+	pools map[string]*DB
 }
 
 func NewOpenAPI() *OpenAPI {
@@ -47,17 +66,94 @@ func (c *OpenAPI) Unmarshal(filename string) error {
 	c.Info = temp.Info
 	c.Servers = temp.Servers
 	c.DB = temp.DB
+	c.Databases = make(map[string]*DB)
 	c.Webserver = temp.Webserver
+	c.Timeout = temp.Timeout
+	c.VerifyMode = temp.VerifyMode
+	c.Routes = temp.Routes
+	c.Webhooks = temp.Webhooks
+	c.Outbox = temp.Outbox
+	c.Pollers = temp.Pollers
+	c.Watchers = temp.Watchers
+	c.Jobs = temp.Jobs
+	c.files = temp.Files()
+	c.pools = make(map[string]*DB)
 	c.Components.init()
 
+	// Stop any pools we have started if the config is invalid
+	defer func() {
+		if err != nil {
+			c.stopPools()
+		}
+	}()
+
 	// Now flatten it using ourselves as the destination
 	err = temp.flatten(c)
 	if err != nil {
 		return err
 	}
 
+	// Generate the paths of any resources
+	err = c.expandResources()
+	if err != nil {
+		return err
+	}
+
+	// Add any routes defined in the database
+	err = c.loadRoutes()
+	if err != nil {
+		return err
+	}
+
+	err = c.loadWebhooks()
+	if err != nil {
+		return err
+	}
+
+	err = c.loadOutbox()
+	if err != nil {
+		return err
+	}
+
+	err = c.loadPollers()
+	if err != nil {
+		return err
+	}
+
+	err = c.loadWatchers()
+	if err != nil {
+		return err
+	}
+
+	// Attach named databases now that we have them all & apply the default timeout
+	err = c.ForEachPath(func(path, method string, m *Method) error {
+		if m.Handler != nil && m.Handler.Timeout == 0 {
+			m.Handler.Timeout = c.Timeout
+		}
+
+		if m.Handler != nil && m.Handler.Database != "" {
+			db, ok := c.Databases[m.Handler.Database]
+			if !ok {
+				return fmt.Errorf("%s %s: unknown database \"%s\"", method, path, m.Handler.Database)
+			}
+			db, err := c.pool(db)
+			m.Handler.DB = db
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.loadJobs()
+	if err != nil {
+		return err
+	}
+
 	// Now handle references
-	return c.resolveReferences()
+	err = c.resolveReferences()
+	return err
 }
 
 func (c *OpenAPI) unmarshal(parent *OpenAPI, filename string) error {
@@ -67,22 +163,39 @@ func (c *OpenAPI) unmarshal(parent *OpenAPI, filename string) error {
 	}
 
 	log.Println("Loading", filename)
+	c.files = append(c.files, filename)
 
 	in, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return err
 	}
 
-	err = yaml.Unmarshal(in, c)
+	var node yaml.Node
+	err = yaml.Unmarshal(in, &node)
+	if err != nil {
+		return err
+	}
+
+	err = interpolate(filename, &node)
 	if err != nil {
 		return err
 	}
 
+	// An empty file has no document
+	if node.Kind != 0 {
+		err = node.Decode(c)
+		if err != nil {
+			return err
+		}
+	}
+
 	if c.DB == nil {
-		if parent == nil {
+		if parent == nil && len(c.Databases) == 0 {
 			return errors.New("Database is mandatory for the root config.yaml")
 		}
-		c.DB = parent.DB
+		if parent != nil {
+			c.DB = parent.DB
+		}
 	}
 
 	if len(c.Imports) > 0 {
@@ -111,6 +224,15 @@ func (c *OpenAPI) unmarshal(parent *OpenAPI, filename string) error {
 	return nil
 }
 
+// Files returns the config files loaded, including any imports
+func (c *OpenAPI) Files() []string {
+	files := c.files
+	for _, child := range c.children {
+		files = append(files, child.Files()...)
+	}
+	return files
+}
+
 // Publish creates a clean valid OpenAPI based on our config.
 func (c *OpenAPI) Publish() *OpenAPI {
 	d := NewOpenAPI()
@@ -144,21 +266,39 @@ func (c *OpenAPI) Publish() *OpenAPI {
 
 func (c *OpenAPI) flatten(d *OpenAPI) error {
 
-	err := c.DB.Start()
+	db, err := d.pool(c.DB)
 	if err != nil {
 		return err
 	}
 
-	// Ensure head Method has it's DB attached
-	_ = c.ForEachPath(func(path, method string, handler *Method) error {
-		if handler.Handler != nil {
-			handler.Handler.DB = c.DB
+	// Ensure each Method has it's DB attached, named databases are attached once everything is flattened
+	err = c.ForEachPath(func(path, method string, handler *Method) error {
+		if handler.Handler != nil && handler.Handler.Database == "" {
+			if db == nil {
+				return fmt.Errorf("%s %s: no database defined", method, AddPrefix(c.Prefix, path))
+			}
+			handler.Handler.DB = db
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	// Import named databases
+	for k, v := range c.Databases {
+		_, exists := d.Databases[k]
+		if exists {
+			return fmt.Errorf("database \"%s\" already exists", k)
+		}
+		d.Databases[k] = v
+	}
 
 	// Import the paths
 	for _, e := range c.Paths.paths {
+		if r := e.path.Resource; r != nil && r.Database == "" {
+			r.db = db
+		}
 		d.Paths.Set(AddPrefix(c.Prefix, e.key), e.path)
 	}
 
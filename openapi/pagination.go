@@ -0,0 +1,315 @@
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/peter-mount/golib/rest"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Pagination pages the rows returned by a set returning handler.
+//
+// Pages are requested with the limit & offset query parameters or a "Range: items=0-24" header. If Cursor is set then
+// keyset pagination is used instead of offset, pages being requested with the opaque after & before parameters
+// taken from the Link header of the previous response.
+//
+// A "Prefer: count=exact" or "Prefer: count=estimated" header includes the total number of rows in the Content-Range
+// header, estimated using the query planner.
+type Pagination struct {
+	// Limit is the number of rows returned when not requested, defaults to MaxLimit
+	Limit int `yaml:"limit,omitempty"`
+	// MaxLimit is the maximum number of rows a request may return, defaults to 1000
+	MaxLimit int `yaml:"maxLimit,omitempty"`
+	// Cursor is the columns, unique together, ordering the rows for keyset pagination
+	Cursor []string `yaml:"cursor,omitempty"`
+}
+
+// The query parameters used by pagination
+var paginationParams = []string{"limit", "offset", "after", "before"}
+
+var rangeHeader = regexp.MustCompile("^items=([0-9]+)-([0-9]*)$")
+
+// page is the page requested
+type page struct {
+	limit  int
+	offset int
+	after  []interface{}
+	before []interface{}
+	count  string
+}
+
+// compile applies the defaults, checks the cursor against the columns & documents the parameters
+func (p *Pagination) compile(m *Method) error {
+	if p.MaxLimit <= 0 {
+		p.MaxLimit = 1000
+	}
+	if p.Limit <= 0 || p.Limit > p.MaxLimit {
+		p.Limit = p.MaxLimit
+	}
+
+	for _, c := range p.Cursor {
+		if !contains(m.Handler.columns, c) {
+			return fmt.Errorf("cursor column %s not in response schema", c)
+		}
+	}
+
+	m.addParameter("limit", "query", false, fmt.Sprintf("Maximum number of rows, defaults to %d", p.Limit), SchemaImpl{Type: "integer"})
+	if len(p.Cursor) == 0 {
+		m.addParameter("offset", "query", false, "Number of rows to skip", SchemaImpl{Type: "integer"})
+	} else {
+		m.addParameter("after", "query", false, "Cursor of the row to start after", SchemaImpl{Type: "string"})
+		m.addParameter("before", "query", false, "Cursor of the row to end before", SchemaImpl{Type: "string"})
+	}
+	m.addParameter("Range", "header", false, "Rows to return, e.g. items=0-24", SchemaImpl{Type: "string"})
+	m.addParameter("Prefer", "header", false, "count=exact or count=estimated to include the total in Content-Range", SchemaImpl{Type: "string"})
+
+	return nil
+}
+
+// page parses the requested page
+func (p *Pagination) page(r *rest.Rest) (*page, error) {
+	pg := &page{limit: p.Limit}
+	values := r.Request().URL.Query()
+
+	if h := r.GetHeader("Range"); h != "" {
+		match := rangeHeader.FindStringSubmatch(h)
+		if match == nil {
+			return nil, Error400("invalid Range %s", h)
+		}
+		pg.offset, _ = strconv.Atoi(match[1])
+		if match[2] != "" {
+			end, _ := strconv.Atoi(match[2])
+			if end < pg.offset {
+				return nil, Error400("invalid Range %s", h)
+			}
+			pg.limit = end - pg.offset + 1
+		}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 1 {
+			return nil, Error400("invalid limit")
+		}
+		pg.limit = i
+	}
+	if pg.limit > p.MaxLimit {
+		pg.limit = p.MaxLimit
+	}
+
+	if v := values.Get("offset"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 {
+			return nil, Error400("invalid offset")
+		}
+		pg.offset = i
+	}
+
+	if len(p.Cursor) > 0 {
+		if pg.offset > 0 {
+			return nil, Error400("offset is not supported, use after or before")
+		}
+
+		var err error
+		pg.after, err = p.decodeCursor(values.Get("after"))
+		if err == nil {
+			pg.before, err = p.decodeCursor(values.Get("before"))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if pg.after != nil && pg.before != nil {
+			return nil, Error400("after and before are mutually exclusive")
+		}
+	}
+
+	for _, pref := range strings.Split(r.GetHeader("Prefer"), ",") {
+		switch strings.TrimSpace(pref) {
+		case "count=exact":
+			pg.count = "exact"
+		case "count=estimated":
+			pg.count = "estimated"
+		}
+	}
+
+	return pg, nil
+}
+
+// decodeCursor decodes a cursor, nil if none
+func (p *Pagination) decodeCursor(s string) ([]interface{}, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, Error400("invalid cursor")
+	}
+
+	var values []interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if d.Decode(&values) != nil || len(values) != len(p.Cursor) {
+		return nil, Error400("invalid cursor")
+	}
+
+	for i, v := range values {
+		if v != nil {
+			values[i] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+// encodeCursor returns the cursor of a row
+func (p *Pagination) encodeCursor(row map[string]json.RawMessage) string {
+	var values []json.RawMessage
+	for _, c := range p.Cursor {
+		v, ok := row[c]
+		if !ok {
+			v = json.RawMessage("null")
+		}
+		values = append(values, v)
+	}
+	b, _ := json.Marshal(values)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// paginate adds the keyset condition, order & limit to a query returning the sql of the page
+func (p *Pagination) paginate(q *query, from string, pg *page) (string, error) {
+	if len(p.Cursor) == 0 {
+		return q.sql(from) + fmt.Sprintf(" LIMIT %d OFFSET %d", pg.limit, pg.offset), nil
+	}
+
+	if len(q.order) > 0 {
+		return "", Error400("order is not supported with cursor pagination")
+	}
+
+	for _, c := range p.Cursor {
+		if len(q.columns) > 0 && !contains(q.columns, "r."+pq.QuoteIdentifier(c)) {
+			return "", Error400("select must include %s", strings.Join(p.Cursor, ","))
+		}
+	}
+
+	var cols, params []string
+	for _, c := range p.Cursor {
+		cols = append(cols, "r."+pq.QuoteIdentifier(c))
+	}
+
+	// When paging backwards we reverse the order then restore it afterwards
+	dir, op, cursor := "ASC", ">", pg.after
+	if pg.before != nil {
+		dir, op, cursor = "DESC", "<", pg.before
+	}
+
+	if cursor != nil {
+		for _, v := range cursor {
+			q.args = append(q.args, v)
+			params = append(params, fmt.Sprintf("$%d", len(q.args)))
+		}
+		q.where = append(q.where, "("+strings.Join(cols, ",")+") "+op+" ("+strings.Join(params, ",")+")")
+	}
+
+	for _, c := range cols {
+		q.order = append(q.order, c+" "+dir)
+	}
+
+	s := q.sql(from) + fmt.Sprintf(" LIMIT %d", pg.limit)
+	if pg.before != nil {
+		s = "SELECT * FROM (" + s + ") r ORDER BY " + strings.Join(cols, ",")
+	}
+	return s, nil
+}
+
+// count returns the total number of rows matching a query, -1 if not requested
+func (p *Pagination) count(ctx context.Context, tx Queryer, countSql string, args []interface{}, pg *page) (int64, error) {
+	switch pg.count {
+	case "exact":
+		var total int64
+		err := tx.QueryRowContext(ctx, "SELECT count(*) FROM ("+countSql+") c", args...).Scan(&total)
+		return total, err
+
+	case "estimated":
+		var plan string
+		err := tx.QueryRowContext(ctx, "EXPLAIN (FORMAT JSON) "+countSql, args...).Scan(&plan)
+		if err != nil {
+			return 0, err
+		}
+
+		var explain []struct {
+			Plan struct {
+				Rows float64 `json:"Plan Rows"`
+			}
+		}
+		err = json.Unmarshal([]byte(plan), &explain)
+		if err != nil || len(explain) == 0 {
+			return 0, err
+		}
+		return int64(explain[0].Plan.Rows), nil
+
+	default:
+		return -1, nil
+	}
+}
+
+// headers adds the Content-Range, Link & Preference-Applied headers of the page
+func (p *Pagination) headers(r *rest.Rest, pg *page, rows []map[string]json.RawMessage, total int64) {
+	n := len(rows)
+
+	totalStr := "*"
+	if total >= 0 {
+		totalStr = strconv.FormatInt(total, 10)
+		r.AddHeader("Preference-Applied", "count="+pg.count)
+	}
+
+	if n == 0 || len(p.Cursor) > 0 {
+		r.AddHeader("Content-Range", "items */"+totalStr)
+	} else {
+		r.AddHeader("Content-Range", fmt.Sprintf("items %d-%d/%s", pg.offset, pg.offset+n-1, totalStr))
+	}
+
+	var links []string
+	link := func(rel, key, value string) {
+		u := *r.Request().URL
+		q := u.Query()
+		for _, k := range paginationParams {
+			q.Del(k)
+		}
+		q.Set("limit", strconv.Itoa(pg.limit))
+		if key != "" {
+			q.Set(key, value)
+		}
+		u.RawQuery = q.Encode()
+		links = append(links, "<"+u.RequestURI()+">; rel=\""+rel+"\"")
+	}
+
+	if len(p.Cursor) == 0 {
+		if n == pg.limit && (total < 0 || int64(pg.offset+n) < total) {
+			link("next", "offset", strconv.Itoa(pg.offset+pg.limit))
+		}
+		if pg.offset > 0 {
+			prev := pg.offset - pg.limit
+			if prev < 0 {
+				prev = 0
+			}
+			link("prev", "offset", strconv.Itoa(prev))
+		}
+	} else if n > 0 {
+		if n == pg.limit || pg.before != nil {
+			link("next", "after", p.encodeCursor(rows[n-1]))
+		}
+		if pg.after != nil || (pg.before != nil && n == pg.limit) {
+			link("prev", "before", p.encodeCursor(rows[0]))
+		}
+	}
+
+	if len(links) > 0 {
+		r.AddHeader("Link", strings.Join(links, ", "))
+	}
+}
@@ -0,0 +1,49 @@
+package openapi
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPaginationCursor(t *testing.T) {
+	p := &Pagination{Cursor: []string{"created", "id"}}
+
+	row := map[string]json.RawMessage{
+		"id":      json.RawMessage("12345678901234567"),
+		"created": json.RawMessage(`"2020-01-02T03:04:05Z"`),
+		"name":    json.RawMessage(`"ignored"`),
+	}
+	cursor := p.encodeCursor(row)
+
+	values, err := p.decodeCursor(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Large ids must not lose precision as a float
+	want := []interface{}{"2020-01-02T03:04:05Z", "12345678901234567"}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("got %#v, want %#v", values, want)
+	}
+
+	// A missing column is null
+	values, err = p.decodeCursor(p.encodeCursor(map[string]json.RawMessage{"id": json.RawMessage("1")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, []interface{}{nil, "1"}) {
+		t.Errorf("missing column: got %#v", values)
+	}
+
+	if values, err = p.decodeCursor(""); values != nil || err != nil {
+		t.Errorf("empty: got %#v %v", values, err)
+	}
+
+	for _, invalid := range []string{"not base64!", "bm90IGpzb24", "WzFd"} {
+		if _, err = p.decodeCursor(invalid); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		} else if e, ok := err.(*restError); !ok || e.Status != 400 {
+			t.Errorf("%q: got %v, want a 400", invalid, err)
+		}
+	}
+}
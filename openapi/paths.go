@@ -67,9 +67,9 @@ func (p Paths) MarshalYAML() (interface{}, error) {
 }
 
 func (p *Paths) Set(key string, path *Path) {
-	for _, e := range p.paths {
+	for i, e := range p.paths {
 		if e.key == key {
-			e.path = path
+			p.paths[i].path = path
 			return
 		}
 	}
@@ -96,6 +96,8 @@ type Path struct {
 	Head        *Method `yaml:"head,omitempty"`
 	Options     *Method `yaml:"options,omitempty"`
 	Trace       *Method `yaml:"trace,omitempty"`
+	// Resource generates the methods of this path from a table or view
+	Resource *Resource `yaml:"resource,omitempty"`
 }
 
 // AddHandler adds a handler to this OpenAPI using the specified path and method.
@@ -127,6 +129,35 @@ func (api *OpenAPI) AddHandler(path, method string, handler *Method) {
 	}
 }
 
+// GetHandler returns the handler for a path and method or nil if none
+func (api *OpenAPI) GetHandler(path, method string) *Method {
+	p := api.Paths.Get(path)
+	if p == nil {
+		return nil
+	}
+
+	switch method {
+	case "get":
+		return p.Get
+	case "post":
+		return p.Post
+	case "put":
+		return p.Put
+	case "patch":
+		return p.Patch
+	case "delete":
+		return p.Delete
+	case "head":
+		return p.Head
+	case "options":
+		return p.Options
+	case "trace":
+		return p.Trace
+	default:
+		return nil
+	}
+}
+
 // ForEachPath calls a function for each path and each method within it.
 // Note this will not call a path with the special summary and description keys
 // used in the OpenAPI spec
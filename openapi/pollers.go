@@ -0,0 +1,295 @@
+package openapi
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/peter-mount/golib/kernel/cron"
+	crn "gopkg.in/robfig/cron.v2"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Poller periodically fetches a url passing the body to a function.
+//
+// Unchanged feeds are skipped using the ETag & Last-Modified of the last successful run, which are kept when the
+// config is reloaded. Bodies are decompressed if either the response or the file itself is gzipped, and a run is
+// skipped if the previous one is still in progress.
+//
+// If Log is set then each run is recorded in that table, which must have the columns:
+//
+//	CREATE TABLE poller_log (
+//	    id          BIGSERIAL PRIMARY KEY,
+//	    poller      TEXT NOT NULL,
+//	    url         TEXT NOT NULL,
+//	    started     TIMESTAMP WITH TIME ZONE NOT NULL,
+//	    duration    DOUBLE PRECISION NOT NULL, -- seconds
+//	    status      TEXT NOT NULL, -- ok, unchanged or failed
+//	    http_status INTEGER,
+//	    bytes       BIGINT,
+//	    error       TEXT
+//	);
+type Poller struct {
+	// URL to fetch
+	URL string `yaml:"url"`
+	// Schedule is a cron expression, e.g. "0 */5 * * * *" or "@every 5m"
+	Schedule string `yaml:"schedule"`
+	// Function called with the body
+	Function string `yaml:"function"`
+	// Binary passes the body as bytea rather than text
+	Binary bool `yaml:"binary,omitempty"`
+	// Headers added to the request, e.g. Authorization
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// Username & Password for basic authentication
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// Timeout in seconds of each run, defaults to 60
+	Timeout int `yaml:"timeout,omitempty"`
+	// MaxSize is the maximum size in bytes of the decompressed body, defaults to 100MB
+	MaxSize int64 `yaml:"maxSize,omitempty"`
+	// Database is the name of an entry in databases to use, defaults to db
+	Database string `yaml:"db,omitempty"`
+	// Log is the table recording each run
+	Log          string `yaml:"log,omitempty"`
+	db           *DB
+	log          string
+	name         string
+	schedule     crn.Schedule
+	client       *http.Client
+	running      int32
+	mutex        sync.Mutex
+	etag         string
+	lastModified string
+}
+
+// pollerRun is the outcome of a run
+type pollerRun struct {
+	status     string
+	httpStatus int
+	bytes      int64
+}
+
+// loadPollers checks the pollers config & attaches their databases
+func (c *OpenAPI) loadPollers() error {
+	for name, p := range c.Pollers {
+		if p == nil || p.URL == "" || p.Schedule == "" || p.Function == "" {
+			return fmt.Errorf("pollers: %s requires url, schedule and function", name)
+		}
+
+		schedule, err := crn.Parse(p.Schedule)
+		if err != nil {
+			return fmt.Errorf("pollers: %s: %s", name, err.Error())
+		}
+		p.schedule = schedule
+
+		if p.Timeout <= 0 {
+			p.Timeout = 60
+		}
+		if p.MaxSize <= 0 {
+			p.MaxSize = 100 * 1024 * 1024
+		}
+		if p.Log != "" {
+			p.log = quoteQualified(p.Log)
+		}
+
+		db, err := c.namedDB(p.Database)
+		if err != nil {
+			return fmt.Errorf("pollers: %s: %s", name, err.Error())
+		}
+		p.db = db
+		p.name = name
+	}
+	return nil
+}
+
+// ReusePollers takes over the ETag & Last-Modified of a previous api's pollers so unchanged feeds are not loaded again
+// when the config is reloaded
+func (c *OpenAPI) ReusePollers(prev *OpenAPI) {
+	for name, p := range c.Pollers {
+		pp, ok := prev.Pollers[name]
+		if !ok || pp.URL != p.URL || pp.Function != p.Function || pp.db != p.db {
+			continue
+		}
+
+		pp.mutex.Lock()
+		p.etag, p.lastModified = pp.etag, pp.lastModified
+		pp.mutex.Unlock()
+	}
+}
+
+// startPollers schedules the pollers
+func (c *OpenAPI) startPollers(cs *cron.CronService) {
+	for _, p := range c.Pollers {
+		p.client = &http.Client{}
+		c.cronEntries = append(c.cronEntries, cs.Schedule(p.schedule, crn.FuncJob(p.poll)))
+	}
+	c.cron = cs
+
+	if len(c.Pollers) > 0 {
+		log.Printf("Pollers: scheduled %d", len(c.Pollers))
+	}
+}
+
+// stopPollers removes the pollers from the schedule, any runs in progress will complete
+func (c *OpenAPI) stopPollers() {
+	for _, id := range c.cronEntries {
+		c.cron.Remove(id)
+	}
+	c.cronEntries = nil
+}
+
+// poll runs the poller unless the previous run is still in progress
+func (p *Poller) poll() {
+	if !atomic.CompareAndSwapInt32(&p.running, 0, 1) {
+		log.Printf("Poller %s: previous run still in progress, skipping", p.name)
+		return
+	}
+	defer atomic.StoreInt32(&p.running, 0)
+
+	started := time.Now()
+	run, err := p.run()
+	duration := time.Since(started)
+
+	if err != nil {
+		run.status = "failed"
+		log.Printf("Poller %s: failed after %.3fs: %s", p.name, duration.Seconds(), err.Error())
+	} else if run.status == "ok" {
+		log.Printf("Poller %s: loaded %d bytes in %.3fs", p.name, run.bytes, duration.Seconds())
+	}
+
+	p.record(started, duration, run, err)
+}
+
+// run fetches the url & passes the body to the function
+func (p *Poller) run() (pollerRun, error) {
+	var run pollerRun
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(p.Timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", p.URL, nil)
+	if err != nil {
+		return run, err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("User-Agent", "dbrest")
+	for k, v := range p.Headers {
+		req.Header.Set(k, v)
+	}
+	if p.Username != "" {
+		req.SetBasicAuth(p.Username, p.Password)
+	}
+
+	p.mutex.Lock()
+	if p.etag != "" {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+	if p.lastModified != "" {
+		req.Header.Set("If-Modified-Since", p.lastModified)
+	}
+	p.mutex.Unlock()
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return run, err
+	}
+	defer resp.Body.Close()
+
+	run.httpStatus = resp.StatusCode
+	if resp.StatusCode == http.StatusNotModified {
+		run.status = "unchanged"
+		return run, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return run, errors.New(resp.Status)
+	}
+
+	body, err := readFeed(resp.Body, p.MaxSize)
+	if err != nil {
+		return run, err
+	}
+	run.bytes = int64(len(body))
+
+	var arg interface{} = body
+	if !p.Binary {
+		arg = string(body)
+	}
+
+	err = p.db.Run(ctx, TxOptions{Transaction: true}, func(q Queryer) error {
+		_, err := q.ExecContext(ctx, "SELECT "+p.Function+"($1)", arg)
+		return err
+	})
+	if err != nil {
+		return run, WrapContextError(ctx, err)
+	}
+
+	// Only remember the validators once loaded so a failed run is retried in full
+	p.mutex.Lock()
+	p.etag = resp.Header.Get("ETag")
+	p.lastModified = resp.Header.Get("Last-Modified")
+	p.mutex.Unlock()
+
+	run.status = "ok"
+	return run, nil
+}
+
+// readFeed reads a body up to max bytes, decompressing it if it's a gzip file.
+// A gzip Content-Encoding has already been decoded by the http client.
+func readFeed(r io.Reader, max int64) ([]byte, error) {
+	r, err := gunzipReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadAll(&maxSizeReader{r: ioutil.NopCloser(r), n: max})
+	if _, ok := err.(*restError); ok {
+		return nil, fmt.Errorf("feed exceeds %d bytes", max)
+	}
+	return b, err
+}
+
+// gunzipReader returns a reader decompressing r if it starts with the gzip magic number, otherwise r as is
+func gunzipReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// record logs a run in the log table
+func (p *Poller) record(started time.Time, duration time.Duration, run pollerRun, err error) {
+	if p.log == "" {
+		return
+	}
+
+	var httpStatus, bytes sql.NullInt64
+	if run.httpStatus > 0 {
+		httpStatus = sql.NullInt64{Int64: int64(run.httpStatus), Valid: true}
+	}
+	if run.status == "ok" {
+		bytes = sql.NullInt64{Int64: run.bytes, Valid: true}
+	}
+	var msg sql.NullString
+	if err != nil {
+		msg = sql.NullString{String: err.Error(), Valid: true}
+	}
+
+	_, err = p.db.Exec(
+		"INSERT INTO "+p.log+" (poller, url, started, duration, status, http_status, bytes, error) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		p.name, p.URL, started, duration.Seconds(), run.status, httpStatus, bytes, msg,
+	)
+	if err != nil {
+		log.Printf("Poller %s: %s: %s", p.name, p.Log, err.Error())
+	}
+}
@@ -0,0 +1,73 @@
+package openapi
+
+import (
+	"errors"
+	"github.com/peter-mount/golib/rest"
+	"strings"
+)
+
+// compileProcedure prepares a handler that uses CALL to invoke a stored procedure.
+//
+// Procedures are run outside of an explicit transaction so that they can use COMMIT and ROLLBACK themselves, so the
+// transaction options are not supported. They are also never retried as the procedure may have already committed.
+func (m *Method) compileProcedure(params []string) error {
+	if (m.Handler.ReadOnly != nil && *m.Handler.ReadOnly) || m.Handler.Isolation != "" || m.Handler.Deferrable {
+		return errors.New("readOnly, isolation and deferrable are not supported for procedures")
+	}
+
+	// OUT parameters are passed as NULL
+	for range m.Handler.Out {
+		params = append(params, "NULL")
+	}
+
+	m.Handler.sql = "CALL " + m.Handler.Procedure + "(" + strings.Join(params, ",") + ")"
+
+	m.Handler.txOptions = TxOptions{}
+
+	return nil
+}
+
+// procedureHandler calls a procedure returning any OUT or INOUT parameters as a json object
+func (m *Method) procedureHandler(r *rest.Rest) error {
+	args, err := m.extractArgs(r)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := m.requestContext(r)
+	defer cancel()
+
+	var result map[string]interface{}
+	err = m.Handler.DB.Run(ctx, m.Handler.txOptions, func(q Queryer) error {
+		rows, err := q.QueryContext(ctx, m.Handler.sql, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		if rows.Next() {
+			result, err = scanRow(rows)
+			if err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return WrapContextError(ctx, err)
+	}
+
+	if result == nil {
+		// No OUT or INOUT parameters
+		r.Status(204)
+		return nil
+	}
+
+	r.Status(200).
+		ContentType(rest.APPLICATION_JSON).
+		Value(result)
+
+	m.cacheControl(r)
+
+	return nil
+}
@@ -0,0 +1,308 @@
+package openapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/peter-mount/golib/rest"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// The comparison operators of the query language, e.g. ?age=gte.18
+var queryOperators = map[string]string{
+	"eq":    "=",
+	"neq":   "<>",
+	"gt":    ">",
+	"gte":   ">=",
+	"lt":    "<",
+	"lte":   "<=",
+	"like":  "LIKE",
+	"ilike": "ILIKE",
+}
+
+// query is a parsed filter, sort & select taken from the url query, e.g.
+//
+// ?status=eq.active&age=gte.18&order=name.asc&select=id,name
+//
+// Filters take the form column=operator.value where the operator is one of eq, neq, gt, gte, lt, lte, like, ilike,
+// in (a comma separated list) or is (null, true or false). Any operator can be prefixed with not.
+// In like & ilike * can be used in place of %.
+type query struct {
+	columns []string
+	where   []string
+	order   []string
+	args    []interface{}
+}
+
+// parseQuery parses the url query against an allow-list of columns.
+// Parameters in skip are ignored. args are any existing arguments, the filter values being appended to them.
+func parseQuery(values url.Values, columns, skip []string, args []interface{}) (*query, error) {
+	q := &query{args: args}
+
+	// Sort the keys so the generated sql is stable
+	var keys []string
+	for k := range values {
+		if !contains(skip, k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, v := range values[k] {
+			var err error
+			switch k {
+			case "select":
+				err = q.parseSelect(v, columns)
+			case "order":
+				err = q.parseOrder(v, columns)
+			default:
+				if !contains(columns, k) {
+					return nil, Error400("unknown column %s", k)
+				}
+				err = q.parseFilter(k, v)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return q, nil
+}
+
+func (q *query) parseSelect(v string, columns []string) error {
+	for _, c := range strings.Split(v, ",") {
+		c = strings.TrimSpace(c)
+		if !contains(columns, c) {
+			return Error400("unknown column %s", c)
+		}
+		q.columns = append(q.columns, "r."+pq.QuoteIdentifier(c))
+	}
+	return nil
+}
+
+func (q *query) parseOrder(v string, columns []string) error {
+	for _, o := range strings.Split(v, ",") {
+		col, dir := strings.TrimSpace(o), "ASC"
+		if i := strings.LastIndex(col, "."); i >= 0 {
+			switch strings.ToLower(col[i+1:]) {
+			case "asc":
+			case "desc":
+				dir = "DESC"
+			default:
+				return Error400("invalid order %s", o)
+			}
+			col = col[:i]
+		}
+		if !contains(columns, col) {
+			return Error400("unknown column %s", col)
+		}
+		q.order = append(q.order, "r."+pq.QuoteIdentifier(col)+" "+dir)
+	}
+	return nil
+}
+
+func (q *query) parseFilter(col, v string) error {
+	not := strings.HasPrefix(v, "not.")
+	if not {
+		v = v[4:]
+	}
+
+	i := strings.Index(v, ".")
+	if i < 0 {
+		return Error400("invalid filter %s", col)
+	}
+	op, val := v[:i], v[i+1:]
+
+	col = "r." + pq.QuoteIdentifier(col)
+
+	var cond string
+	switch op {
+	case "in":
+		q.args = append(q.args, pq.Array(strings.Split(val, ",")))
+		cond = fmt.Sprintf("%s = ANY($%d)", col, len(q.args))
+
+	case "is":
+		switch strings.ToLower(val) {
+		case "null":
+			cond = col + " IS NULL"
+		case "true":
+			cond = col + " IS TRUE"
+		case "false":
+			cond = col + " IS FALSE"
+		default:
+			return Error400("invalid filter %s", col)
+		}
+
+	case "like", "ilike":
+		q.args = append(q.args, strings.Replace(val, "*", "%", -1))
+		cond = fmt.Sprintf("%s::text %s $%d", col, queryOperators[op], len(q.args))
+
+	default:
+		sqlOp, ok := queryOperators[op]
+		if !ok {
+			return Error400("invalid operator %s", op)
+		}
+		q.args = append(q.args, val)
+		cond = fmt.Sprintf("%s %s $%d", col, sqlOp, len(q.args))
+	}
+
+	if not {
+		cond = "NOT (" + cond + ")"
+	}
+	q.where = append(q.where, cond)
+
+	return nil
+}
+
+// sql returns the select wrapped around from which must alias the rows as r
+func (q *query) sql(from string) string {
+	sel := "r.*"
+	if len(q.columns) > 0 {
+		sel = strings.Join(q.columns, ",")
+	}
+
+	s := "SELECT " + sel + " FROM " + from
+	if len(q.where) > 0 {
+		s = s + " WHERE " + strings.Join(q.where, " AND ")
+	}
+	if len(q.order) > 0 {
+		s = s + " ORDER BY " + strings.Join(q.order, ",")
+	}
+	return s
+}
+
+// jsonArray wraps a query so it returns its rows as a single json array
+func jsonArray(s string) string {
+	return "SELECT COALESCE(json_agg(t), '[]'::json)::text FROM (" + s + ") t"
+}
+
+// compileQuery prepares a handler using the query language or pagination around its set returning function
+func (m *Method) compileQuery(params []string) error {
+	m.Handler.columns = m.responseColumns()
+	if len(m.Handler.columns) == 0 {
+		return fmt.Errorf("query requires a 200 response schema with properties")
+	}
+
+	// Parameters bound to the function's arguments are not filters, unlike the external ones of a resource
+	for _, p := range m.Parameters {
+		if !p.external {
+			m.Handler.skip = append(m.Handler.skip, p.Name)
+		}
+	}
+
+	if p := m.Handler.Pagination; p != nil {
+		err := p.compile(m)
+		if err != nil {
+			return err
+		}
+		m.Handler.skip = append(m.Handler.skip, paginationParams...)
+	}
+
+	if m.Handler.crud != nil {
+		m.Handler.sql = m.Handler.crud.resource.Table + " r"
+	} else {
+		m.Handler.sql = m.Handler.Function + "(" + strings.Join(params, ",") + ") r"
+	}
+	return nil
+}
+
+// responseColumns returns the property names of the 200 response, or of its items if it's an array
+func (m *Method) responseColumns() []string {
+	var columns []string
+	if resp, ok := m.Responses["200"]; ok {
+		for _, c := range resp.Content {
+			s := c.Schema
+			if s != nil && s.Type == "array" {
+				s = s.Items
+			}
+			if s != nil {
+				for k := range s.Properties {
+					columns = append(columns, k)
+				}
+			}
+		}
+	}
+	return columns
+}
+
+// queryError maps a filter value that's invalid for its column, e.g. age=gte.abc, to a 400
+func queryError(ctx context.Context, err error) error {
+	if pe, ok := err.(*pq.Error); ok && pe.Code.Class() == "22" && ctx.Err() == nil {
+		return Error400(pe.Message)
+	}
+	return WrapContextError(ctx, err)
+}
+
+// queryHandler calls a set returning function applying the query language and pagination to its result
+func (m *Method) queryHandler(r *rest.Rest) error {
+	args, err := m.extractArgs(r)
+	if err != nil {
+		return err
+	}
+
+	q := &query{args: args}
+	if m.Handler.Query {
+		q, err = parseQuery(r.Request().URL.Query(), m.Handler.columns, m.Handler.skip, args)
+		if err != nil {
+			return err
+		}
+	}
+
+	p := m.Handler.Pagination
+	var pg *page
+	var countSql string
+	var countArgs []interface{}
+	sql := q.sql(m.Handler.sql)
+	if p != nil {
+		pg, err = p.page(r)
+		if err != nil {
+			return err
+		}
+
+		// Count before paginating as that adds the keyset condition
+		countSql, countArgs = sql, append([]interface{}{}, q.args...)
+
+		sql, err = p.paginate(q, m.Handler.sql, pg)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := m.requestContext(r)
+	defer cancel()
+
+	var result string
+	total := int64(-1)
+	err = m.Handler.DB.Run(ctx, m.Handler.txOptions, func(tx Queryer) error {
+		err := tx.QueryRowContext(ctx, jsonArray(sql), q.args...).Scan(&result)
+		if err == nil && p != nil {
+			total, err = p.count(ctx, tx, countSql, countArgs, pg)
+		}
+		return err
+	})
+	if err != nil {
+		return queryError(ctx, err)
+	}
+
+	if p != nil {
+		var rows []map[string]json.RawMessage
+		err = json.Unmarshal([]byte(result), &rows)
+		if err != nil {
+			return err
+		}
+		p.headers(r, pg, rows, total)
+	}
+
+	r.Status(200).
+		ContentType(rest.APPLICATION_JSON).
+		Reader(strings.NewReader(result))
+
+	m.cacheControl(r)
+
+	return nil
+}
@@ -0,0 +1,165 @@
+package openapi
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replicaSet manages the read only replicas of a DB, periodically checking their health and replication lag
+type replicaSet struct {
+	replicas []*replica
+	maxLag   float64
+	counter  uint32
+	done     chan interface{}
+	stopped  sync.Once
+}
+
+type replica struct {
+	name    string
+	db      *sql.DB
+	healthy int32
+}
+
+func newReplicaSet(d *DB) (*replicaSet, error) {
+	s := &replicaSet{
+		maxLag: float64(d.MaxLag),
+		done:   make(chan interface{}),
+	}
+
+	for _, uri := range d.Replicas {
+		db, err := d.open(uri)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.replicas = append(s.replicas, &replica{name: replicaName(uri), db: db})
+	}
+
+	interval := d.HealthCheck
+	if interval <= 0 {
+		interval = 10
+	}
+
+	go s.run(time.Duration(interval) * time.Second)
+
+	return s, nil
+}
+
+func (s *replicaSet) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Until the first check completes all requests go to the primary
+	s.check()
+
+	for {
+		select {
+		case <-s.done:
+			s.close()
+			return
+		case <-ticker.C:
+			s.check()
+		}
+	}
+}
+
+// stop stops the health checks & closes the replicas, which are marked unhealthy so requests still being
+// handled use the primary
+func (s *replicaSet) stop() {
+	s.stopped.Do(func() {
+		for _, r := range s.replicas {
+			atomic.StoreInt32(&r.healthy, 0)
+		}
+		close(s.done)
+	})
+}
+
+func (s *replicaSet) close() {
+	for _, r := range s.replicas {
+		_ = r.db.Close()
+	}
+}
+
+func (s *replicaSet) check() {
+	for _, r := range s.replicas {
+		healthy := s.checkReplica(r)
+		select {
+		case <-s.done:
+			// Left unhealthy by stop
+			return
+		default:
+		}
+
+		var v int32
+		if healthy {
+			v = 1
+		}
+		if atomic.SwapInt32(&r.healthy, v) != v {
+			log.Printf("replica %s healthy %v", r.name, healthy)
+		}
+	}
+}
+
+// replicaName returns the host & database of a replica's connection string for logging, as it may contain a password
+func replicaName(uri string) string {
+	if dsn, err := pq.ParseURL(uri); err == nil && dsn != "" {
+		uri = dsn
+	}
+
+	host, port, dbname := "localhost", "", ""
+	for _, f := range strings.Fields(uri) {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := strings.Trim(kv[1], "'")
+		switch kv[0] {
+		case "host":
+			host = v
+		case "port":
+			port = ":" + v
+		case "dbname":
+			dbname = v
+		}
+	}
+	return host + port + "/" + dbname
+}
+
+// checkReplica returns true if the replica is in recovery and within the allowed replication lag.
+// The lag is 0 once all of the wal received has been replayed whilst streaming from the primary, as the time since
+// the last replayed transaction keeps growing whilst the primary is idle. Seeing the wal receiver's status requires
+// the user to be a member of pg_read_all_stats, without which the lag is always the time since the last replayed
+// transaction.
+func (s *replicaSet) checkReplica(r *replica) bool {
+	var recovery bool
+	var lag float64
+	err := r.db.QueryRow(
+		"SELECT pg_is_in_recovery(),"+
+			" CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn()"+
+			" AND EXISTS (SELECT 1 FROM pg_stat_wal_receiver WHERE status = 'streaming') THEN 0"+
+			" ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END",
+	).Scan(&recovery, &lag)
+	if err != nil {
+		return false
+	}
+
+	return recovery && (s.maxLag <= 0 || lag <= s.maxLag)
+}
+
+// next returns the next healthy replica in round-robin order or nil if none are healthy
+func (s *replicaSet) next() *sql.DB {
+	l := uint32(len(s.replicas))
+	start := atomic.AddUint32(&s.counter, 1)
+	for i := uint32(0); i < l; i++ {
+		r := s.replicas[(start+i)%l]
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			return r.db
+		}
+	}
+	return nil
+}
@@ -125,6 +125,9 @@ func (s *Response) visit(r *Resolver) error {
 	for _, cont := range s.Content {
 		if cont.Schema != nil {
 			err := r.visit(cont.Schema.Reference, cont.Schema.visit)
+			if err == nil && cont.Schema.Items != nil {
+				err = r.visit(cont.Schema.Items.Reference, cont.Schema.Items.visit)
+			}
 			if err != nil {
 				return err
 			}
@@ -0,0 +1,471 @@
+package openapi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/peter-mount/golib/rest"
+	"io/ioutil"
+	"strings"
+)
+
+// Resource generates list, get, create, update and delete operations for a table or view.
+//
+// The path it's defined on handles list (get) and create (post). A second path, the original suffixed with the
+// primary key columns, handles get, update and delete. Update with put replaces the row, columns missing from the body
+// being set to their default or null, whilst patch only updates the columns in the body.
+//
+// Views have no primary key so Key must be set for them to have the get, update & delete operations.
+type Resource struct {
+	// Table is the table or view, optionally schema qualified
+	Table string `yaml:"table"`
+	// Database is the name of an entry in databases to use, defaults to db
+	Database string `yaml:"db,omitempty"`
+	// Operations limits the operations generated, defaults to all for tables and list & get for views, get, update &
+	// delete requiring a key. Valid entries are "list", "get", "create", "update" and "delete"
+	Operations []string `yaml:"operations,omitempty"`
+	// Tags to apply to the generated operations
+	Tags []string `yaml:"tags,omitempty"`
+	// MaxAge for the list & get operations
+	MaxAge int `yaml:"maxAge,omitempty"`
+	// MaxLimit is the maximum number of rows list will return, defaults to 1000
+	MaxLimit int `yaml:"maxLimit,omitempty"`
+	// Key is the columns identifying a row, defaults to the primary key
+	Key     []string `yaml:"key,omitempty"`
+	db      *DB
+	name    string
+	view    bool
+	columns []resourceColumn
+	pk      []string
+}
+
+type resourceColumn struct {
+	name    string
+	pgType  string
+	primary bool
+}
+
+// crudOp is attached to a Handler generated for a Resource
+type crudOp struct {
+	resource *Resource
+	op       string
+}
+
+// expandResources generates the paths for each Resource.
+// This must be called once flattened as it requires the database.
+func (c *OpenAPI) expandResources() error {
+	// Take a copy as we add paths
+	entries := append([]pathEntry{}, c.Paths.paths...)
+
+	for _, e := range entries {
+		r := e.path.Resource
+		if r == nil {
+			continue
+		}
+
+		if r.Database != "" {
+			db, ok := c.Databases[r.Database]
+			if !ok {
+				return fmt.Errorf("%s: unknown database \"%s\"", e.key, r.Database)
+			}
+			r.db = db
+		}
+		if r.db == nil {
+			return fmt.Errorf("%s: no database defined", e.key)
+		}
+
+		db, err := c.pool(r.db)
+		if err != nil {
+			return err
+		}
+		r.db = db
+
+		err = r.introspect()
+		if err != nil {
+			return fmt.Errorf("%s: %s", e.key, err.Error())
+		}
+
+		err = c.addResource(e.key, e.path, r)
+		if err != nil {
+			return fmt.Errorf("%s: %s", e.key, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// introspect reads the columns & primary key of the table
+func (r *Resource) introspect() error {
+	var relkind string
+	err := r.db.QueryRow("SELECT relkind::text FROM pg_class WHERE oid = $1::regclass", r.Table).Scan(&relkind)
+	if err != nil {
+		return err
+	}
+	r.view = relkind == "v" || relkind == "m"
+
+	rows, err := r.db.Query(
+		"SELECT a.attname, format_type(a.atttypid, a.atttypmod), "+
+			"COALESCE(a.attnum = ANY(i.indkey), false) "+
+			"FROM pg_attribute a "+
+			"LEFT JOIN pg_index i ON i.indrelid = a.attrelid AND i.indisprimary "+
+			"WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped "+
+			"ORDER BY a.attnum",
+		r.Table,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var col resourceColumn
+		err = rows.Scan(&col.name, &col.pgType, &col.primary)
+		if err != nil {
+			return err
+		}
+		r.columns = append(r.columns, col)
+		if col.primary {
+			r.pk = append(r.pk, col.name)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if len(r.columns) == 0 {
+		return fmt.Errorf("%s has no columns", r.Table)
+	}
+
+	if len(r.Key) > 0 {
+		for _, k := range r.Key {
+			if r.column(k) == nil {
+				return fmt.Errorf("key column %s not in %s", k, r.Table)
+			}
+		}
+		r.pk = r.Key
+	}
+
+	// The name used for the schema in components
+	r.name = strings.Replace(r.Table, ".", "_", -1)
+
+	r.Table = quoteQualified(r.Table)
+
+	return nil
+}
+
+func (r *Resource) column(name string) *resourceColumn {
+	for i, c := range r.columns {
+		if c.name == name {
+			return &r.columns[i]
+		}
+	}
+	return nil
+}
+
+func (r *Resource) columnNames() []string {
+	var names []string
+	for _, c := range r.columns {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+func (r *Resource) hasOperation(op string) bool {
+	if len(r.Operations) > 0 {
+		return contains(r.Operations, op)
+	}
+	if isItemOperation(op) && len(r.pk) == 0 {
+		return false
+	}
+	if r.view {
+		return op == "list" || op == "get"
+	}
+	return true
+}
+
+// isItemOperation returns true if the operation is on a single row so requires a key
+func isItemOperation(op string) bool {
+	return op == "get" || op == "update" || op == "delete"
+}
+
+// addResource generates the methods for a resource
+func (c *OpenAPI) addResource(path string, p *Path, r *Resource) error {
+	for _, op := range r.Operations {
+		if !contains([]string{"list", "get", "create", "update", "delete"}, op) {
+			return fmt.Errorf("unsupported operation \"%s\"", op)
+		}
+		if isItemOperation(op) && len(r.pk) == 0 {
+			return fmt.Errorf("operation \"%s\" requires a primary key or key", op)
+		}
+	}
+
+	// The schema of a row
+	schema := Schema{}
+	schema.Type = "object"
+	schema.Properties = make(map[string]*Schema)
+	for _, col := range r.columns {
+		s := &Schema{}
+		s.SchemaImpl = pgSchema(col.pgType)
+		schema.Properties[col.name] = s
+	}
+	if _, exists := c.Components.Schemas[r.name]; exists {
+		return fmt.Errorf("schema \"%s\" already exists", r.name)
+	}
+	c.Components.Schemas[r.name] = schema
+
+	ref := &Schema{Reference: Reference{Ref: "#/components/schemas/" + r.name}}
+	array := &Schema{}
+	array.Type = "array"
+	array.Items = ref
+
+	if r.hasOperation("list") {
+		m := r.method("list", "List "+r.Table)
+		for _, col := range r.columns {
+			m.addParameter(col.name, "query", false, "Filter by "+col.name+", e.g. eq.value", SchemaImpl{Type: "string"})
+		}
+		m.addParameter("select", "query", false, "Comma separated columns to return", SchemaImpl{Type: "string"})
+		m.addParameter("order", "query", false, "Comma separated columns to order by, suffixed with .asc or .desc", SchemaImpl{Type: "string"})
+		m.Handler.Query = true
+		m.Handler.Pagination = &Pagination{MaxLimit: r.MaxLimit}
+		m.addResponse("200", "OK", array)
+		p.Get = m
+	}
+
+	if r.hasOperation("create") {
+		m := r.method("create", "Create "+r.Table)
+		m.RequestBody = jsonRequestBody(ref)
+		m.addResponse("201", "Created", ref)
+		p.Post = m
+	}
+
+	if len(r.pk) == 0 {
+		return nil
+	}
+
+	itemPath := path
+	for _, k := range r.pk {
+		itemPath = itemPath + "/{" + k + "}"
+	}
+
+	item := c.Paths.Get(itemPath)
+	if item == nil {
+		item = &Path{}
+		c.Paths.Set(itemPath, item)
+	}
+
+	if r.hasOperation("get") {
+		m := r.method("get", "Get "+r.Table)
+		m.addKeyParameters()
+		m.addResponse("200", "OK", ref)
+		m.addResponse("404", "Not found", nil)
+		item.Get = m
+	}
+
+	if r.hasOperation("update") {
+		m := r.method("replace", "Replace "+r.Table)
+		m.addKeyParameters()
+		m.RequestBody = jsonRequestBody(ref)
+		m.addResponse("200", "OK", ref)
+		m.addResponse("404", "Not found", nil)
+		item.Put = m
+
+		m = r.method("update", "Update "+r.Table)
+		m.addKeyParameters()
+		m.RequestBody = jsonRequestBody(ref)
+		m.addResponse("200", "OK", ref)
+		m.addResponse("404", "Not found", nil)
+		item.Patch = m
+	}
+
+	if r.hasOperation("delete") {
+		m := r.method("delete", "Delete "+r.Table)
+		m.addKeyParameters()
+		m.addResponse("204", "Deleted", nil)
+		m.addResponse("404", "Not found", nil)
+		item.Delete = m
+	}
+
+	return nil
+}
+
+func (r *Resource) method(op, summary string) *Method {
+	m := &Method{
+		Tags:      r.Tags,
+		Summary:   summary,
+		Responses: make(map[string]Response),
+		Handler: &Handler{
+			ContentType: rest.APPLICATION_JSON,
+			DB:          r.db,
+			crud:        &crudOp{resource: r, op: op},
+		},
+	}
+	if op == "list" || op == "get" {
+		m.Handler.MaxAge = r.MaxAge
+	}
+	return m
+}
+
+// addParameter adds a parameter. Optional parameters are handled by the crud handler itself
+func (m *Method) addParameter(name, in string, required bool, description string, schema SchemaImpl) {
+	p := &Parameter{}
+	p.Name = name
+	p.In = in
+	p.Required = required
+	p.Description = description
+	p.Schema.SchemaImpl = schema
+	p.external = !required
+	m.Parameters = append(m.Parameters, p)
+}
+
+func (m *Method) addKeyParameters() {
+	r := m.Handler.crud.resource
+	for _, k := range r.pk {
+		m.addParameter(k, "path", true, "", pgSchema(r.column(k).pgType))
+	}
+}
+
+func (m *Method) addResponse(status, description string, schema *Schema) {
+	resp := Response{}
+	resp.Description = description
+	if schema != nil {
+		resp.Content = map[string]ResponseEntry{rest.APPLICATION_JSON: {Schema: schema}}
+	}
+	m.Responses[status] = resp
+}
+
+func jsonRequestBody(schema *Schema) *RequestBody {
+	return &RequestBody{
+		Required: true,
+		Content:  map[string]ResponseEntry{rest.APPLICATION_JSON: {Schema: schema}},
+	}
+}
+
+// crudHandler implements the operations of a Resource
+func (m *Method) crudHandler(r *rest.Rest) error {
+	op := m.Handler.crud
+	res := op.resource
+
+	// The primary key from the path
+	args, err := m.extractArgs(r)
+	if err != nil {
+		return err
+	}
+
+	var query string
+	switch op.op {
+	case "get":
+		query = "SELECT row_to_json(t)::text FROM " + res.Table + " t WHERE " + res.keyCondition(1)
+
+	case "create", "update", "replace":
+		body, cols, err := res.body(r)
+		if err != nil {
+			return err
+		}
+
+		if op.op == "create" {
+			query = "INSERT INTO " + res.Table + " AS t (" + strings.Join(cols, ",") + ")" +
+				" SELECT " + strings.Join(cols, ",") +
+				" FROM json_populate_record(NULL::" + res.Table + ", $1::json)" +
+				" RETURNING row_to_json(t)::text"
+		} else {
+			var set []string
+			for _, c := range cols {
+				set = append(set, c+" = r."+c)
+			}
+			if op.op == "replace" {
+				// Replace the whole row, apart from the key
+				for _, c := range res.columns {
+					qc := pq.QuoteIdentifier(c.name)
+					if !contains(cols, qc) && !contains(res.pk, c.name) {
+						set = append(set, qc+" = DEFAULT")
+					}
+				}
+			}
+			query = "UPDATE " + res.Table + " AS t SET " + strings.Join(set, ",") +
+				" FROM json_populate_record(NULL::" + res.Table + ", $1::json) r" +
+				" WHERE " + res.keyCondition(2) +
+				" RETURNING row_to_json(t)::text"
+		}
+		args = append([]interface{}{body}, args...)
+
+	case "delete":
+		query = "DELETE FROM " + res.Table + " AS t WHERE " + res.keyCondition(1) + " RETURNING ''"
+	}
+
+	ctx, cancel := m.requestContext(r)
+	defer cancel()
+
+	var result sql.NullString
+	err = m.Handler.DB.Run(ctx, m.Handler.txOptions, func(q Queryer) error {
+		return q.QueryRowContext(ctx, query, args...).Scan(&result)
+	})
+	if err == sql.ErrNoRows {
+		return Error404("")
+	}
+	if err != nil {
+		return WrapContextError(ctx, err)
+	}
+
+	switch op.op {
+	case "delete":
+		r.Status(204)
+		return nil
+	case "create":
+		r.Status(201)
+	default:
+		r.Status(200)
+	}
+
+	r.ContentType(rest.APPLICATION_JSON).
+		Reader(strings.NewReader(result.String))
+
+	m.cacheControl(r)
+
+	return nil
+}
+
+// keyCondition returns the WHERE condition matching the primary key with the parameters starting at $start
+func (r *Resource) keyCondition(start int) string {
+	var cond []string
+	for i, k := range r.pk {
+		cond = append(cond, fmt.Sprintf("t.%s = $%d", pq.QuoteIdentifier(k), start+i))
+	}
+	return strings.Join(cond, " AND ")
+}
+
+// body reads the json object in the request body returning it along with the quoted column names it contains
+func (r *Resource) body(req *rest.Rest) (string, []string, error) {
+	br, err := req.BodyReader()
+	if err != nil {
+		return "", nil, err
+	}
+
+	b, err := ioutil.ReadAll(br)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var obj map[string]json.RawMessage
+	err = json.Unmarshal(b, &obj)
+	if err != nil {
+		return "", nil, Error400("body must be a json object")
+	}
+	if len(obj) == 0 {
+		return "", nil, Error400("empty body")
+	}
+
+	var cols []string
+	for _, c := range r.columns {
+		if _, ok := obj[c.name]; ok {
+			cols = append(cols, pq.QuoteIdentifier(c.name))
+			delete(obj, c.name)
+		}
+	}
+
+	for k := range obj {
+		return "", nil, Error400("unknown column %s", k)
+	}
+
+	return string(b), cols, nil
+}
@@ -10,6 +10,13 @@ type ResponseImpl struct {
 	Content     map[string]ResponseEntry `yaml:"content,omitempty"`
 }
 
+// RequestBody describes the body of a request
+type RequestBody struct {
+	Description string                   `yaml:"description,omitempty"`
+	Required    bool                     `yaml:"required,omitempty"`
+	Content     map[string]ResponseEntry `yaml:"content,omitempty"`
+}
+
 type ResponseEntry struct {
 	Schema *Schema `yaml:"schema,omitempty"`
 }
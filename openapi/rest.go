@@ -2,18 +2,26 @@ package openapi
 
 import (
 	"fmt"
+	"github.com/gorilla/mux"
 	"github.com/peter-mount/golib/rest"
 	"io/ioutil"
 	"log"
 )
 
-// ForEachPath calls a function for each path and each method within it.
-// Note this will not call a path with the special summary and description keys
-// used in the OpenAPI spec
-func (api *OpenAPI) Start(server *rest.Server) error {
-	return api.ForEachPath(func(path, method string, m *Method) error {
-		return m.start(path, method, server)
+// Start compiles each method, verifies them against the database and registers them with the router
+func (api *OpenAPI) Start(router *mux.Router) error {
+	err := api.ForEachPath(func(path, method string, m *Method) error {
+		return m.start(path, method, router)
 	})
+	if err != nil {
+		return err
+	}
+
+	if api.Jobs != nil {
+		api.Jobs.route(router)
+	}
+
+	return api.verify()
 }
 
 // paramHandler is a function that extracts a parameter or fails if invalid
@@ -38,12 +46,18 @@ func (m *Method) extractArgs(r *rest.Rest) ([]interface{}, error) {
 func (m *Method) compile() error {
 
 	for _, param := range m.Parameters {
+		if param.external {
+			continue
+		}
+		param.urlQuery = m.Handler.URLQuery
+
 		h, err := param.compile()
 		if err != nil {
 			return err
 		}
 		if h != nil {
 			m.paramHandlers = append(m.paramHandlers, h)
+			m.argParams = append(m.argParams, param)
 		}
 	}
 
@@ -58,11 +72,42 @@ func (param *Parameter) compile() (paramHandler, error) {
 		return nil, err
 	}
 
+	// File content is bytea so can't be validated as a string
+	if param.In == "file" {
+		return h, nil
+	}
+
 	h, err = param.Schema.compile(param.Name, h)
 
+	if param.urlQuery && !param.Required && param.Schema.Nullable && param.Schema.Default == nil {
+		h = param.nullIfMissing(h)
+	}
+
 	return h, nil
 }
 
+// nullIfMissing returns null for a missing query or header parameter rather than validating it
+func (param *Parameter) nullIfMissing(h paramHandler) paramHandler {
+	return func(r *rest.Rest) (interface{}, error) {
+		var val string
+		switch param.In {
+		case "header":
+			val = r.GetHeader(param.Name)
+		case "query":
+			val = r.Var(param.Name)
+			if val == "" {
+				val = r.Request().URL.Query().Get(param.Name)
+			}
+		default:
+			return h(r)
+		}
+		if val == "" {
+			return nil, nil
+		}
+		return h(r)
+	}
+}
+
 // compileParam returns a paramHandler that extracts the value.
 // This is used prior to any other paramHandler's to validate the value
 func (param *Parameter) compileParam() (paramHandler, error) {
@@ -87,6 +132,9 @@ func (param *Parameter) compileParam() (paramHandler, error) {
 		return func(r *rest.Rest) (interface{}, error) {
 			val := r.GetHeader(param.Name)
 			if val == "" {
+				if param.urlQuery && param.Schema.Default != nil {
+					return fmt.Sprint(param.Schema.Default), nil
+				}
 				return nil, fmt.Errorf("missing header %s", param.Name)
 			}
 			return val, nil
@@ -102,16 +150,40 @@ func (param *Parameter) compileParam() (paramHandler, error) {
 			return val, nil
 		}, nil
 
-		// Query params are handed the same as path in mux
+		// Query params are handed the same as path in mux unless taken from the url
 	case "query":
 		return func(r *rest.Rest) (interface{}, error) {
 			val := r.Var(param.Name)
+			if val == "" && param.urlQuery {
+				val = r.Request().URL.Query().Get(param.Name)
+			}
 			if val == "" {
+				if param.urlQuery && param.Schema.Default != nil {
+					return fmt.Sprint(param.Schema.Default), nil
+				}
 				return nil, fmt.Errorf("missing query %s", param.Name)
 			}
 			return val, nil
 		}, nil
 
+	// Non OpenAPI standard, a field from the verified client certificate when using mutual TLS
+	case "tls":
+		f, err := certificateField(param.Name)
+		if err != nil {
+			return nil, err
+		}
+		return func(r *rest.Rest) (interface{}, error) {
+			cert := clientCertificate(r)
+			if cert == nil {
+				return nil, fmt.Errorf("missing client certificate %s", param.Name)
+			}
+			return f(cert), nil
+		}, nil
+
+	// Non OpenAPI standard, from a multipart/form-data body
+	case "form", "file", "largeobject", "filename", "filetype":
+		return param.compileUploadParam(), nil
+
 	default:
 		return nil, fmt.Errorf("no in for \"%s\"", param.Name)
 	}
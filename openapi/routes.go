@@ -0,0 +1,103 @@
+package openapi
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"log"
+	"strings"
+)
+
+// Routes defines an optional source of paths held within the database.
+//
+// The table or function must return three columns: the path, the method and the definition of the method in json or
+// yaml, i.e. the same as it would be defined in the config.
+type Routes struct {
+	// Table containing the routes
+	Table string `yaml:"table,omitempty"`
+	// Function returning the routes, an alternative to Table
+	Function string `yaml:"function,omitempty"`
+	// Database is the name of an entry in databases to use, defaults to db
+	Database string `yaml:"db,omitempty"`
+	// Channel if set is a NOTIFY channel which when notified causes the routes to be reloaded
+	Channel string `yaml:"channel,omitempty"`
+	db      *DB
+}
+
+// DB returns the database the routes are loaded from
+func (r *Routes) DB() *DB {
+	return r.db
+}
+
+// loadRoutes loads any routes from the database, adding them to our paths.
+// Routes already defined in the config take precedence over those in the database.
+func (c *OpenAPI) loadRoutes() error {
+	if c.Routes == nil {
+		return nil
+	}
+
+	routes := c.Routes
+	if (routes.Table == "") == (routes.Function == "") {
+		return errors.New("routes requires one of table or function")
+	}
+
+	db := c.DB
+	if routes.Database != "" {
+		var ok bool
+		db, ok = c.Databases[routes.Database]
+		if !ok {
+			return fmt.Errorf("routes: unknown database \"%s\"", routes.Database)
+		}
+	}
+	if db == nil {
+		return errors.New("routes: no database defined")
+	}
+
+	db, err := c.pool(db)
+	if err != nil {
+		return err
+	}
+	routes.db = db
+
+	query := "SELECT * FROM " + routes.Table
+	if routes.Function != "" {
+		query = "SELECT * FROM " + routes.Function + "()"
+	}
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return fmt.Errorf("routes: %s", err.Error())
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var path, method, definition string
+		err = rows.Scan(&path, &method, &definition)
+		if err != nil {
+			return fmt.Errorf("routes: %s", err.Error())
+		}
+
+		path = addSlash(path)
+		method = strings.ToLower(method)
+
+		m := &Method{}
+		err = yaml.Unmarshal([]byte(definition), m)
+		if err != nil {
+			return fmt.Errorf("routes: %s %s: %s", method, path, err.Error())
+		}
+
+		if c.GetHandler(path, method) != nil {
+			log.Printf("routes: %s %s already defined, ignoring", method, path)
+			continue
+		}
+
+		// Handlers use the routes database unless they name one
+		if m.Handler != nil && m.Handler.Database == "" {
+			m.Handler.DB = db
+		}
+
+		c.AddHandler(path, method, m)
+	}
+
+	return rows.Err()
+}
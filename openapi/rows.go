@@ -0,0 +1,52 @@
+package openapi
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// scanRow scans the current row into a map keyed by column name.
+// Values are converted so they encode to the equivalent json type.
+func scanRow(rows *sql.Rows) (map[string]interface{}, error) {
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, len(types))
+	ptrs := make([]interface{}, len(types))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+
+	err = rows.Scan(ptrs...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]interface{})
+	for i, t := range types {
+		result[t.Name()] = jsonValue(t.DatabaseTypeName(), values[i])
+	}
+	return result, nil
+}
+
+// jsonValue converts a value returned by the driver so that it encodes correctly as json
+func jsonValue(dbType string, v interface{}) interface{} {
+	switch b := v.(type) {
+	case []byte:
+		switch dbType {
+		case "JSON", "JSONB":
+			return json.RawMessage(b)
+		case "NUMERIC":
+			return json.Number(b)
+		default:
+			return string(b)
+		}
+	case time.Time:
+		return b.Format(time.RFC3339Nano)
+	default:
+		return v
+	}
+}
@@ -28,6 +28,8 @@ type SchemaImpl struct {
 	Properties           map[string]*Schema `yaml:"properties,omitempty"`
 	Items                *Schema            `yaml:"items,omitempty"`
 	AdditionalProperties *Schema            `yaml:"additionalProperties,omitempty"`
+	// Nullable with Handler.URLQuery passes an optional query or header parameter that's missing as null
+	Nullable bool `yaml:"nullable,omitempty"`
 }
 
 func (p *Schema) MarshalYAML() (interface{}, error) {
@@ -0,0 +1,217 @@
+package openapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/peter-mount/golib/rest"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLS defines the certificates used by the webserver.
+// The files are checked for changes periodically and reloaded without a restart.
+type TLS struct {
+	// CertFile is the PEM encoded certificate, optionally with the chain appended
+	CertFile string `yaml:"cert"`
+	// KeyFile is the PEM encoded private key
+	KeyFile string `yaml:"key"`
+	// ClientCA if set is a PEM bundle of CA's used to verify client certificates
+	ClientCA string `yaml:"clientCA,omitempty"`
+	// ClientAuth is one of "none", "request", "verify" or "require".
+	// Defaults to "require" if ClientCA is set otherwise "none"
+	ClientAuth string `yaml:"clientAuth,omitempty"`
+	// ReloadInterval is the minimum number of seconds between checking the files for changes, defaults to 30
+	ReloadInterval int `yaml:"reloadInterval,omitempty"`
+	mutex          sync.Mutex
+	config         *tls.Config
+	lastCheck      time.Time
+	modTimes       map[string]time.Time
+}
+
+// Config returns the tls.Config to use with the http server.
+// The returned config delegates to the current config so any changes to the files are picked up on the next
+// handshake.
+func (t *TLS) Config() (*tls.Config, error) {
+	if t.CertFile == "" || t.KeyFile == "" {
+		return nil, errors.New("tls requires both cert and key")
+	}
+
+	if t.ReloadInterval <= 0 {
+		t.ReloadInterval = 30
+	}
+
+	_, err := t.clientAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// GetCertificate is never called as GetConfigForClient returns a config with the certificate, but net/http
+	// requires either it or Certificates to be set
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return t.current(), nil
+		},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &t.current().Certificates[0], nil
+		},
+	}, nil
+}
+
+func (t *TLS) clientAuth() (tls.ClientAuthType, error) {
+	switch t.ClientAuth {
+	case "":
+		if t.ClientCA != "" {
+			return tls.RequireAndVerifyClientCert, nil
+		}
+		return tls.NoClientCert, nil
+	case "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "verify":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("invalid clientAuth \"%s\"", t.ClientAuth)
+	}
+}
+
+// current returns the current config, reloading it if any of the files have changed.
+// If the reload fails then the previous config is kept.
+func (t *TLS) current() *tls.Config {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if time.Since(t.lastCheck) >= time.Duration(t.ReloadInterval)*time.Second {
+		t.lastCheck = time.Now()
+		if t.changed() {
+			err := t.loadLocked()
+			if err != nil {
+				log.Println("tls reload failed, keeping previous certificates:", err)
+			} else {
+				log.Println("tls certificates reloaded")
+			}
+		}
+	}
+
+	return t.config
+}
+
+func (t *TLS) load() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.lastCheck = time.Now()
+	return t.loadLocked()
+}
+
+func (t *TLS) loadLocked() error {
+	modTimes, err := t.fileModTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	clientAuth, err := t.clientAuth()
+	if err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuth,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if t.ClientCA != "" {
+		b, err := ioutil.ReadFile(t.ClientCA)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates found in %s", t.ClientCA)
+		}
+		config.ClientCAs = pool
+	}
+
+	t.config = config
+	t.modTimes = modTimes
+	return nil
+}
+
+func (t *TLS) files() []string {
+	files := []string{t.CertFile, t.KeyFile}
+	if t.ClientCA != "" {
+		files = append(files, t.ClientCA)
+	}
+	return files
+}
+
+func (t *TLS) fileModTimes() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, f := range t.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[f] = fi.ModTime()
+	}
+	return modTimes, nil
+}
+
+// changed returns true if any of the files have changed since they were last loaded
+func (t *TLS) changed() bool {
+	modTimes, err := t.fileModTimes()
+	if err != nil {
+		// Probably mid-update so try again on the next check
+		return false
+	}
+
+	for f, m := range modTimes {
+		if !m.Equal(t.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientCertificate returns the verified client certificate for a request or nil if none
+func clientCertificate(r *rest.Rest) *x509.Certificate {
+	state := r.Request().TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// certificateField returns a function to extract a named field from a client certificate
+func certificateField(name string) (func(*x509.Certificate) string, error) {
+	switch name {
+	case "subject":
+		return func(c *x509.Certificate) string { return c.Subject.String() }, nil
+	case "commonName":
+		return func(c *x509.Certificate) string { return c.Subject.CommonName }, nil
+	case "issuer":
+		return func(c *x509.Certificate) string { return c.Issuer.String() }, nil
+	case "serialNumber":
+		return func(c *x509.Certificate) string { return c.SerialNumber.String() }, nil
+	default:
+		return nil, fmt.Errorf("unsupported tls parameter \"%s\"", name)
+	}
+}
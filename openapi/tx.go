@@ -0,0 +1,135 @@
+package openapi
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Queryer is implemented by both sql.DB and sql.Tx so a handler can run with or without a transaction
+type Queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+// TxOptions defines how a call is run against the database
+type TxOptions struct {
+	// ReadOnly runs the call in a READ ONLY transaction on a replica if one is available
+	ReadOnly bool
+	// Timeout if >0 sets the statement_timeout for the call
+	Timeout time.Duration
+	// Isolation is the transaction isolation level, sql.LevelDefault for the database default
+	Isolation sql.IsolationLevel
+	// Deferrable makes the transaction DEFERRABLE, only meaningful with SERIALIZABLE READ ONLY
+	Deferrable bool
+	// Transaction forces an explicit transaction
+	Transaction bool
+	// Retries is the maximum number of times to retry on a serialization failure or deadlock
+	Retries int
+}
+
+// ParseIsolation parses an isolation level as used in the config
+func ParseIsolation(s string) (sql.IsolationLevel, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return sql.LevelDefault, nil
+	case "read committed":
+		return sql.LevelReadCommitted, nil
+	case "repeatable read":
+		return sql.LevelRepeatableRead, nil
+	case "serializable":
+		return sql.LevelSerializable, nil
+	default:
+		return sql.LevelDefault, fmt.Errorf("unsupported isolation \"%s\"", s)
+	}
+}
+
+// transactional returns true if the options require an explicit transaction
+func (o TxOptions) transactional() bool {
+	return o.Transaction || o.ReadOnly || o.Timeout > 0 || o.Isolation != sql.LevelDefault || o.Deferrable
+}
+
+// Run runs f against the database. If the options require it then f is run within a transaction which is committed
+// if f returns nil.
+//
+// If the call fails due to a serialization failure or deadlock then it's retried, up to opts.Retries times, after a
+// random delay.
+//
+// ctx should be the request context so that the backend query is cancelled if the client disconnects.
+func (d *DB) Run(ctx context.Context, opts TxOptions, f func(q Queryer) error) error {
+	for attempt := 0; ; attempt++ {
+		err := d.run(ctx, opts, f)
+		if err == nil || attempt >= opts.Retries || !isRetryable(err) {
+			return err
+		}
+
+		// Exponential backoff with jitter, starting at up to 20ms & capped at up to 5s
+		shift := attempt
+		if shift > maxRetryShift {
+			shift = maxRetryShift
+		}
+		backoff := time.Duration(rand.Int63n(int64(20*time.Millisecond) << uint(shift)))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// maxRetryShift caps the retry backoff at 20ms << 8, about 5s
+const maxRetryShift = 8
+
+// isRetryable returns true if err is a serialization failure or deadlock
+func isRetryable(err error) bool {
+	if pe, ok := err.(*pq.Error); ok {
+		return pe.Code == "40001" || pe.Code == "40P01"
+	}
+	return false
+}
+
+func (d *DB) run(ctx context.Context, opts TxOptions, f func(q Queryer) error) error {
+	if !opts.transactional() {
+		return f(d.db)
+	}
+
+	db := d.db
+	if opts.ReadOnly && d.replicas != nil {
+		if r := d.replicas.next(); r != nil {
+			db = r
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if opts.Deferrable {
+		_, err = tx.ExecContext(ctx, "SET TRANSACTION DEFERRABLE")
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Timeout > 0 {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", opts.Timeout/time.Millisecond))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = f(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,249 @@
+package openapi
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/peter-mount/golib/rest"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"strings"
+)
+
+// Parameter locations taken from a multipart/form-data body.
+//
+// in: form is the value of a form field.
+//
+// in: file is the content of a file part passed as bytea.
+//
+// in: largeobject streams a file part into a new large object passing its OID.
+//
+// in: filename & in: filetype are the file name & content type of the file part with the same name.
+var uploadLocations = []string{"form", "file", "largeobject", "filename", "filetype"}
+
+// The default maximum size of a part
+const defaultMaxPartSize = 10 * 1024 * 1024
+
+// The size of the chunks written to a large object
+const largeObjectChunkSize = 256 * 1024
+
+// The rest attribute holding the parsed upload
+const uploadAttribute = "dbrest.upload"
+
+// upload is the parsed multipart body
+type upload struct {
+	values    map[string]interface{}
+	filenames map[string]string
+	filetypes map[string]string
+}
+
+// isUpload returns true if the method takes any parameters from a multipart body
+func (m *Method) isUpload() bool {
+	for _, p := range m.Parameters {
+		if contains(uploadLocations, p.In) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileUpload prepares a handler that takes parameters from a multipart body
+func (m *Method) compileUpload(params []string) error {
+	for _, p := range m.Parameters {
+		if p.In == "body" {
+			return fmt.Errorf("parameter %s cannot be in body with a multipart upload", p.Name)
+		}
+	}
+
+	if m.Handler.MaxPartSize <= 0 {
+		m.Handler.MaxPartSize = defaultMaxPartSize
+	}
+
+	m.Handler.sql = "SELECT " + m.Handler.Function + "(" + strings.Join(params, ",") + ")"
+
+	// Large objects must be created in the same transaction as the call, which can't be retried as the body has gone
+	m.Handler.txOptions.Transaction = true
+	m.Handler.txOptions.Retries = 0
+
+	return nil
+}
+
+// compileUploadParam returns the paramHandler for a parameter in a multipart body
+func (param *Parameter) compileUploadParam() paramHandler {
+	return func(r *rest.Rest) (interface{}, error) {
+		var u *upload
+		if a, ok := r.GetAttribute(uploadAttribute); ok {
+			u = a.(*upload)
+		} else {
+			return nil, Error400("expected multipart/form-data")
+		}
+
+		var val interface{}
+		var ok bool
+		switch param.In {
+		case "filename":
+			val, ok = u.filenames[param.Name]
+		case "filetype":
+			val, ok = u.filetypes[param.Name]
+		default:
+			val, ok = u.values[param.Name]
+		}
+
+		if !ok {
+			if param.Schema.Default != nil {
+				return fmt.Sprint(param.Schema.Default), nil
+			}
+			return nil, Error400("missing %s %s", param.In, param.Name)
+		}
+		return val, nil
+	}
+}
+
+// uploadHandler parses a multipart body then calls the function within the same transaction
+func (m *Method) uploadHandler(r *rest.Rest) error {
+	mr, err := r.Request().MultipartReader()
+	if err != nil {
+		return Error400("expected multipart/form-data")
+	}
+
+	ctx, cancel := m.requestContext(r)
+	defer cancel()
+
+	var result sql.NullString
+	err = m.Handler.DB.Run(ctx, m.Handler.txOptions, func(q Queryer) error {
+		u, err := m.readUpload(ctx, q, mr)
+		if err != nil {
+			return err
+		}
+		r.SetAttribute(uploadAttribute, u)
+
+		args, err := m.extractArgs(r)
+		if err != nil {
+			return err
+		}
+
+		return q.QueryRowContext(ctx, m.Handler.sql, args...).Scan(&result)
+	})
+	if err != nil {
+		return WrapContextError(ctx, err)
+	}
+
+	return m.writeResult(r, result)
+}
+
+// readUpload reads each part of the body, storing any large objects as it goes
+func (m *Method) readUpload(ctx context.Context, q Queryer, mr *multipart.Reader) (*upload, error) {
+	u := &upload{
+		values:    make(map[string]interface{}),
+		filenames: make(map[string]string),
+		filetypes: make(map[string]string),
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return u, nil
+		}
+		if err != nil {
+			return nil, Error400("invalid multipart body: %s", err.Error())
+		}
+
+		name := part.FormName()
+		param := m.uploadParameter(name)
+		if param == nil {
+			// Not one we want so skip it
+			_, err = io.Copy(ioutil.Discard, part)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		limit := m.Handler.MaxPartSize
+		if param.Schema.MaxLength != nil {
+			limit = int64(*param.Schema.MaxLength)
+		}
+
+		var body io.Reader = part
+		if limit > 0 {
+			body = &maxSizeReader{r: part, n: limit}
+		}
+
+		switch param.In {
+		case "largeobject":
+			oid, err := writeLargeObject(ctx, q, name, body)
+			if err != nil {
+				return nil, err
+			}
+			u.values[name] = fmt.Sprint(oid)
+
+		case "file":
+			b, err := ioutil.ReadAll(body)
+			if err != nil {
+				return nil, partError(name, err)
+			}
+			u.values[name] = b
+
+		default:
+			b, err := ioutil.ReadAll(body)
+			if err != nil {
+				return nil, partError(name, err)
+			}
+			u.values[name] = string(b)
+		}
+
+		if part.FileName() != "" {
+			u.filenames[name] = part.FileName()
+		}
+		if ct := part.Header.Get("Content-Type"); ct != "" {
+			u.filetypes[name] = ct
+		}
+	}
+}
+
+// uploadParameter returns the parameter receiving the content of a part, nil if none
+func (m *Method) uploadParameter(name string) *Parameter {
+	for _, p := range m.Parameters {
+		if p.Name == name && (p.In == "form" || p.In == "file" || p.In == "largeobject") {
+			return p
+		}
+	}
+	return nil
+}
+
+// writeLargeObject streams r into a new large object returning its OID
+func writeLargeObject(ctx context.Context, q Queryer, name string, r io.Reader) (uint32, error) {
+	var oid uint32
+	err := q.QueryRowContext(ctx, "SELECT lo_from_bytea(0, ''::bytea)").Scan(&oid)
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, largeObjectChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			_, err := q.ExecContext(ctx, "SELECT lo_put($1, $2, $3)", oid, offset, buf[:n])
+			if err != nil {
+				return 0, err
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return oid, nil
+		}
+		if err != nil {
+			return 0, partError(name, err)
+		}
+	}
+}
+
+// partError converts an error reading a part into a response
+func partError(name string, err error) error {
+	if re, ok := err.(*restError); ok {
+		return NewError(re.Status, "%s: %s", name, re.Message)
+	}
+	return Error400("invalid multipart body: %s", err.Error())
+}
@@ -0,0 +1,257 @@
+package openapi
+
+import (
+	"fmt"
+	"github.com/lib/pq"
+	"log"
+	"strings"
+)
+
+// Verification modes
+const (
+	VerifyOff  = "off"
+	VerifyWarn = "warn"
+	VerifyFail = "fail"
+)
+
+// pgFunction is an entry from pg_proc
+type pgFunction struct {
+	signature   string
+	nargs       int
+	nargdefault int
+	argTypes    []string
+	returnType  string
+	returnsSet  bool
+	kind        string
+}
+
+// Postgres types compatible with the schema types we validate parameters against.
+// Anything not listed here is treated as a string which Postgres will cast.
+var schemaTypes = map[string][]string{
+	"integer": {"smallint", "integer", "bigint", "numeric", "real", "double precision", "text", "character varying"},
+	"boolean": {"boolean", "text", "character varying"},
+}
+
+// Postgres return types compatible with a response content type.
+// Any content type not listed is not checked.
+var contentTypes = map[string][]string{
+	"application/json": {"json", "jsonb", "text", "character varying"},
+	"text/json":        {"json", "jsonb", "text", "character varying"},
+	"application/xml":  {"xml", "text", "character varying"},
+	"text/xml":         {"xml", "text", "character varying"},
+	"application/yaml": {"text", "character varying"},
+	"text/yaml":        {"text", "character varying"},
+	"text/plain":       {"text", "character varying"},
+	"text/csv":         {"text", "character varying"},
+}
+
+// Verify checks every function and procedure used by the handlers exists in pg_proc with arguments and a return type
+// compatible with the config. It returns a list of problems, one per path & method.
+//
+// The handlers must have been compiled, i.e. Start() must have been called.
+func (api *OpenAPI) Verify() ([]string, error) {
+	var problems []string
+
+	err := api.ForEachPath(func(path, method string, m *Method) error {
+		if m.Handler == nil {
+			return nil
+		}
+
+		problem, err := m.verify()
+		if err != nil {
+			return err
+		}
+
+		if problem != "" {
+			problems = append(problems, fmt.Sprintf("%s %s: %s", method, path, problem))
+		}
+		return nil
+	})
+
+	return problems, err
+}
+
+// verify checks a single handler returning a description of the problem, "" if none
+func (m *Method) verify() (string, error) {
+	name, kind, kindName := m.Handler.Function, "f", "function"
+	if m.Handler.Procedure != "" {
+		name, kind, kindName = m.Handler.Procedure, "p", "procedure"
+	}
+	if name == "" {
+		return "", nil
+	}
+
+	fns, err := m.Handler.DB.lookupFunction(name)
+	if err != nil {
+		return "", err
+	}
+	if len(fns) == 0 {
+		return fmt.Sprintf("%s not found", name), nil
+	}
+
+	nargs := len(m.paramHandlers)
+	if kind == "p" {
+		nargs += len(m.Handler.Out)
+	}
+
+	// Find the best match, the first with the correct arity
+	var problems []string
+	for _, fn := range fns {
+		if fn.kind != kind {
+			problems = append(problems, fmt.Sprintf("%s is not a %s", fn.signature, kindName))
+			continue
+		}
+
+		if nargs < fn.nargs-fn.nargdefault || nargs > fn.nargs {
+			problems = append(problems, fmt.Sprintf("%s expects %d arguments, %d configured", fn.signature, fn.nargs, nargs))
+			continue
+		}
+
+		problem := m.verifyFunction(fn)
+		if problem == "" {
+			return "", nil
+		}
+		problems = append(problems, problem)
+	}
+
+	return strings.Join(problems, "; "), nil
+}
+
+// verifyFunction checks the parameter and return types of a function with the correct arity
+func (m *Method) verifyFunction(fn pgFunction) string {
+	for i, param := range m.argParams {
+		if i >= len(fn.argTypes) {
+			break
+		}
+		if compatible, ok := schemaTypes[param.Schema.Type]; ok && !contains(compatible, fn.argTypes[i]) {
+			return fmt.Sprintf("%s argument %d is %s but parameter %s is %s",
+				fn.signature, i+1, fn.argTypes[i], param.Name, param.Schema.Type)
+		}
+	}
+
+	// The result of a procedure, the post-processing function of a copy or an authorisation function is not returned
+	if fn.kind == "p" || m.Handler.Copy != nil || m.Handler.Events != nil ||
+		m.Handler.WebSocket != nil {
+		return ""
+	}
+
+	// Large objects are found by column name at runtime
+	if m.Handler.LargeObject != nil {
+		return ""
+	}
+
+	if m.Handler.returnsSet() {
+		if !fn.returnsSet {
+			return fmt.Sprintf("%s does not return a set as required by query, pagination and export", fn.signature)
+		}
+		return ""
+	}
+
+	if fn.returnsSet {
+		return fmt.Sprintf("%s returns a set but only a single value is supported", fn.signature)
+	}
+
+	if compatible, ok := contentTypes[m.contentType()]; ok && !contains(compatible, fn.returnType) {
+		return fmt.Sprintf("%s returns %s which is incompatible with %s", fn.signature, fn.returnType, m.contentType())
+	}
+
+	return ""
+}
+
+// prokind returns the sql for the kind of a function in pg_proc p, which before PostgreSQL 11 & procedures has to be
+// derived from proisagg & proiswindow
+func (d *DB) prokind() (string, error) {
+	var version int
+	err := d.QueryRow("SELECT current_setting('server_version_num')::integer").Scan(&version)
+	if err != nil {
+		return "", err
+	}
+	if version >= 110000 {
+		return "p.prokind", nil
+	}
+	return "CASE WHEN p.proisagg THEN 'a' WHEN p.proiswindow THEN 'w' ELSE 'f' END", nil
+}
+
+// lookupFunction returns all overloads of a function visible to the connection
+func (d *DB) lookupFunction(name string) ([]pgFunction, error) {
+	schema := ""
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		schema, name = name[:i], name[i+1:]
+	}
+
+	prokind, err := d.prokind()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := d.Query(
+		"SELECT p.oid::regprocedure::text, p.pronargs, p.pronargdefaults, "+
+			"p.proargtypes::regtype[]::text[], p.prorettype::regtype::text, p.proretset, "+prokind+" "+
+			"FROM pg_proc p JOIN pg_namespace n ON n.oid = p.pronamespace "+
+			"WHERE p.proname = $1 "+
+			"AND (($2 = '' AND n.nspname = ANY(current_schemas(false))) OR n.nspname = $2)",
+		strings.ToLower(name), strings.ToLower(schema),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fns []pgFunction
+	for rows.Next() {
+		var fn pgFunction
+		var argTypes pq.StringArray
+		err = rows.Scan(&fn.signature, &fn.nargs, &fn.nargdefault, &argTypes, &fn.returnType, &fn.returnsSet, &fn.kind)
+		if err != nil {
+			return nil, err
+		}
+		fn.argTypes = argTypes
+		fns = append(fns, fn)
+	}
+
+	return fns, rows.Err()
+}
+
+// verify runs Verify applying the verification mode
+func (api *OpenAPI) verify() error {
+	mode := api.VerifyMode
+	if mode == "" {
+		mode = VerifyWarn
+	}
+
+	switch mode {
+	case VerifyOff:
+		return nil
+	case VerifyWarn, VerifyFail:
+	default:
+		return fmt.Errorf("invalid verify \"%s\"", mode)
+	}
+
+	problems, err := api.Verify()
+	if err != nil {
+		if mode == VerifyFail {
+			return err
+		}
+		log.Println("Verify failed:", err)
+		return nil
+	}
+
+	for _, p := range problems {
+		log.Println("Verify:", p)
+	}
+
+	if mode == VerifyFail && len(problems) > 0 {
+		return fmt.Errorf("%d handlers failed verification", len(problems))
+	}
+
+	return nil
+}
+
+func contains(a []string, s string) bool {
+	for _, e := range a {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,347 @@
+package openapi
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Watcher ingests files dropped into a directory, e.g. by SFTP.
+//
+// The directory is scanned every Poll seconds for files matching Pattern that have not been modified for Settle
+// seconds, so files still being written are left alone. Each file is moved to Processing, passed to the function
+// within a transaction, then moved to Done if it's committed or Failed if the function or its data was rejected.
+// If the database could not be reached the file is moved back to be ingested on the next scan. Gzipped files are
+// decompressed.
+//
+// A file left in Processing, as it could not be moved once ingested or dbrest stopped whilst ingesting it, is not
+// ingested again as it may have been committed, so it's logged when the watcher starts for someone to check.
+//
+// The mode determines what's passed to the function:
+//
+// text (the default) the content as text and the file name.
+//
+// binary the content as bytea and the file name.
+//
+// path the absolute path of the file in Processing and the file name, for when the database can read the file itself.
+//
+// copy the content is copied into a table as with a copy handler, then the function, if any, is called with the file
+// name.
+//
+// Only one instance should watch a directory as files are not locked whilst being ingested.
+type Watcher struct {
+	// Dir is the directory to watch
+	Dir string `yaml:"dir"`
+	// Pattern is the glob files must match, defaults to *
+	Pattern string `yaml:"pattern,omitempty"`
+	// Function to call with each file
+	Function string `yaml:"function,omitempty"`
+	// Mode is one of text, binary, path or copy
+	Mode string `yaml:"mode,omitempty"`
+	// Copy defines the table the file is copied into with mode copy
+	Copy *Copy `yaml:"copy,omitempty"`
+	// Done is the directory files are moved to once ingested, defaults to done within Dir
+	Done string `yaml:"done,omitempty"`
+	// Failed is the directory files are moved to if they fail, defaults to failed within Dir
+	Failed string `yaml:"failed,omitempty"`
+	// Processing is the directory files are moved to whilst being ingested, defaults to processing within Dir
+	Processing string `yaml:"processing,omitempty"`
+	// Poll is the interval in seconds between scanning the directory, defaults to 10
+	Poll int `yaml:"poll,omitempty"`
+	// Settle is the time in seconds since a file was last modified before it's ingested, defaults to 5
+	Settle int `yaml:"settle,omitempty"`
+	// Timeout in seconds to ingest each file, 0 for none
+	Timeout int `yaml:"timeout,omitempty"`
+	// Database is the name of an entry in databases to use, defaults to db
+	Database string `yaml:"db,omitempty"`
+	db       *DB
+	name     string
+	stuck    map[string]bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// loadWatchers checks the watchers config & attaches their databases
+func (c *OpenAPI) loadWatchers() error {
+	for name, w := range c.Watchers {
+		err := w.compile()
+		if err != nil {
+			return fmt.Errorf("watchers: %s: %s", name, err.Error())
+		}
+
+		db, err := c.namedDB(w.Database)
+		if err != nil {
+			return fmt.Errorf("watchers: %s: %s", name, err.Error())
+		}
+		w.db = db
+		w.name = name
+	}
+	return nil
+}
+
+// compile checks the config, applying the defaults
+func (w *Watcher) compile() error {
+	if w.Dir == "" {
+		return errors.New("dir is required")
+	}
+	dir, err := filepath.Abs(w.Dir)
+	if err != nil {
+		return err
+	}
+	w.Dir = dir
+
+	if w.Pattern == "" {
+		w.Pattern = "*"
+	}
+	if _, err = filepath.Match(w.Pattern, ""); err != nil {
+		return err
+	}
+
+	switch w.Mode {
+	case "", "text", "binary", "path":
+		if w.Function == "" {
+			return errors.New("function is required")
+		}
+	case "copy":
+		if w.Copy == nil {
+			return errors.New("mode copy requires copy")
+		}
+		err = w.Copy.compile()
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported mode \"%s\"", w.Mode)
+	}
+
+	if w.Done == "" {
+		w.Done = filepath.Join(w.Dir, "done")
+	}
+	if w.Failed == "" {
+		w.Failed = filepath.Join(w.Dir, "failed")
+	}
+	if w.Processing == "" {
+		w.Processing = filepath.Join(w.Dir, "processing")
+	}
+	if w.Poll <= 0 {
+		w.Poll = 10
+	}
+	if w.Settle <= 0 {
+		w.Settle = 5
+	}
+
+	return nil
+}
+
+// start starts watching the directory
+func (w *Watcher) start() {
+	for _, dir := range []string{w.Done, w.Failed, w.Processing} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("Watcher %s: %s", w.name, err.Error())
+		}
+	}
+
+	if left, _ := filepath.Glob(filepath.Join(w.Processing, "*")); len(left) > 0 {
+		log.Printf("Watcher %s: %d files left in %s may have been ingested, check & move them", w.name, len(left), w.Processing)
+	}
+
+	w.stuck = make(map[string]bool)
+	w.done = make(chan struct{})
+	w.wg.Add(1)
+	go w.run()
+
+	log.Printf("Watcher %s: watching %s", w.name, filepath.Join(w.Dir, w.Pattern))
+}
+
+// stop stops watching, abandoning any file being ingested
+func (w *Watcher) stop() {
+	if w.done != nil {
+		close(w.done)
+		w.wg.Wait()
+		w.done = nil
+	}
+}
+
+func (w *Watcher) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(w.Poll) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		w.scan()
+
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan ingests each file that's ready in name order
+func (w *Watcher) scan() {
+	files, err := filepath.Glob(filepath.Join(w.Dir, w.Pattern))
+	if err != nil {
+		log.Printf("Watcher %s: %s", w.name, err.Error())
+		return
+	}
+	sort.Strings(files)
+
+	settled := time.Now().Add(-time.Duration(w.Settle) * time.Second)
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil || !fi.Mode().IsRegular() || fi.ModTime().After(settled) || w.stuck[file] {
+			continue
+		}
+
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+
+		// Claim the file so if it can't be moved once ingested it's not ingested again
+		processing, err := w.move(file, w.Processing)
+		if err != nil {
+			// Left in place it would fail again so ignore it until we are restarted
+			log.Printf("Watcher %s: %s, ignoring %s", w.name, err.Error(), filepath.Base(file))
+			w.stuck[file] = true
+			continue
+		}
+
+		start := time.Now()
+		err = w.ingest(processing)
+		switch {
+		case err == nil:
+			log.Printf("Watcher %s: %s ingested in %.3fs", w.name, filepath.Base(file), time.Since(start).Seconds())
+			w.moveFrom(processing, w.Done)
+
+		case err == context.Canceled || isUnavailable(err):
+			// Stopped or the database is unavailable so leave it to be ingested next time
+			if err != context.Canceled {
+				log.Printf("Watcher %s: %s will be retried: %s", w.name, filepath.Base(file), err.Error())
+			}
+			w.moveFrom(processing, w.Dir)
+			return
+
+		default:
+			log.Printf("Watcher %s: %s failed: %s", w.name, filepath.Base(file), err.Error())
+			w.moveFrom(processing, w.Failed)
+		}
+	}
+}
+
+// isUnavailable returns true if an error ingesting a file was due to reaching the database, so the file can be
+// retried, rather than the function or the file's data being rejected
+func isUnavailable(err error) bool {
+	// The timeout is a net.Error but it's the file taking too long
+	if err == context.DeadlineExceeded {
+		return false
+	}
+
+	switch e := err.(type) {
+	case *pq.Error:
+		switch e.Code.Class() {
+		case "08", "53", "57", "58":
+			// Connection exception, insufficient resources, operator intervention & system error
+			return true
+		}
+		return isRetryable(err)
+	case net.Error:
+		return true
+	}
+	return err == driver.ErrBadConn
+}
+
+// ingest passes a file to the function within a transaction
+func (w *Watcher) ingest(file string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	if w.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(w.Timeout)*time.Second)
+	}
+	defer cancel()
+
+	// Abandon the file if we are stopped
+	go func() {
+		select {
+		case <-w.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	name := filepath.Base(file)
+
+	// The file is only read once so the call can't be retried
+	err := w.db.Run(ctx, TxOptions{Transaction: true}, func(q Queryer) error {
+		if w.Mode == "path" {
+			_, err := q.ExecContext(ctx, "SELECT "+w.Function+"($1, $2)", file, name)
+			return err
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		r, err := gunzipReader(f)
+		if err != nil {
+			return err
+		}
+
+		if w.Mode == "copy" {
+			_, err = w.Copy.copyFrom(ctx, q, r)
+			if err == nil && w.Function != "" {
+				_, err = q.ExecContext(ctx, "SELECT "+w.Function+"($1)", name)
+			}
+			return err
+		}
+
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+
+		var content interface{} = string(b)
+		if w.Mode == "binary" {
+			content = b
+		}
+
+		_, err = q.ExecContext(ctx, "SELECT "+w.Function+"($1, $2)", content, name)
+		return err
+	})
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// move moves a file into a directory returning its new path, adding a suffix if a file with the same name is already
+// there
+func (w *Watcher) move(file, dir string) (string, error) {
+	dest := filepath.Join(dir, filepath.Base(file))
+	if _, err := os.Stat(dest); err == nil {
+		dest = dest + "." + strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	return dest, os.Rename(file, dest)
+}
+
+// moveFrom moves a file out of processing, leaving it there if it can't be moved
+func (w *Watcher) moveFrom(file, dir string) {
+	if _, err := w.move(file, dir); err != nil {
+		log.Printf("Watcher %s: %s, leaving %s in %s", w.name, err.Error(), filepath.Base(file), w.Processing)
+	}
+}
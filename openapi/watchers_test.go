@@ -0,0 +1,41 @@
+package openapi
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"github.com/lib/pq"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestIsUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "connection failure", err: &pq.Error{Code: "08006"}, want: true},
+		{name: "admin shutdown", err: &pq.Error{Code: "57P01"}, want: true},
+		{name: "too many connections", err: &pq.Error{Code: "53300"}, want: true},
+		{name: "serialization failure", err: &pq.Error{Code: "40001"}, want: true},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}, want: true},
+		{name: "bad connection", err: driver.ErrBadConn, want: true},
+		{name: "invalid input", err: &pq.Error{Code: "22P02"}},
+		{name: "raised by the function", err: &pq.Error{Code: "P0001"}},
+		{name: "invalid copy data", err: Error400("line 2: expected 3 fields, got 2")},
+		{name: "truncated gzip", err: io.ErrUnexpectedEOF},
+		{name: "invalid gzip", err: gzip.ErrHeader},
+		{name: "unreadable file", err: &os.PathError{Op: "open", Path: "x", Err: os.ErrPermission}},
+		{name: "timeout", err: context.DeadlineExceeded},
+	}
+
+	for _, test := range tests {
+		if got := isUnavailable(test.err); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,547 @@
+package openapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Webhooks delivers the notifications of channels to urls.
+//
+// Each notification is posted to the urls of its channel, or those returned by a function called with the channel &
+// payload, and retried with exponential backoff until it's accepted. A delivery is dead once it has failed Retries
+// times or been rejected with a 4xx status other than 408 or 429.
+//
+// If Secret is set each request is signed with the header X-Webhook-Signature: sha256=hex, the HMAC-SHA256 of the
+// X-Webhook-Timestamp header, a ".", then the body.
+//
+// If Log is set then each delivery is recorded in that table, which must have the columns:
+//
+//	CREATE TABLE webhook_log (
+//	    id              BIGSERIAL PRIMARY KEY,
+//	    channel         TEXT NOT NULL,
+//	    url             TEXT NOT NULL,
+//	    payload         TEXT,
+//	    status          TEXT NOT NULL, -- pending, retrying, delivered or dead
+//	    attempts        INTEGER NOT NULL DEFAULT 0,
+//	    response_status INTEGER,
+//	    error           TEXT,
+//	    created         TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+//	    updated         TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+//	);
+//
+// Deliveries are made by a pool of Workers. When the config is reloaded the subscriptions & any deliveries not yet
+// made are handed over to the new config so none are lost. On shutdown any deliveries not yet made are left pending
+// or retrying in the log, if any, and resumed on the next start.
+//
+// As notifications are only received whilst listening, those sent whilst dbrest is not running are not delivered.
+// Every instance receives each notification so only one instance should have webhooks.
+type Webhooks struct {
+	// Database is the name of an entry in databases to use, defaults to db
+	Database string `yaml:"db,omitempty"`
+	// Channels maps each channel to its webhook
+	Channels map[string]*Webhook `yaml:"channels"`
+	// Secret signs each request
+	Secret string `yaml:"secret,omitempty"`
+	// Log is the table recording each delivery
+	Log string `yaml:"log,omitempty"`
+	// Retries is the number of times a failed delivery is retried, defaults to 5, <0 for none
+	Retries int `yaml:"retries,omitempty"`
+	// Backoff is the delay in seconds before the first retry, doubling each time, defaults to 1
+	Backoff int `yaml:"backoff,omitempty"`
+	// MaxBackoff is the maximum delay in seconds between retries, defaults to 300
+	MaxBackoff int `yaml:"maxBackoff,omitempty"`
+	// Timeout in seconds of each request, defaults to 10
+	Timeout int `yaml:"timeout,omitempty"`
+	// Buffer is the number of notifications queued before some are lost, defaults to 1024
+	Buffer int `yaml:"buffer,omitempty"`
+	// Workers is the number of deliveries made at the same time, defaults to 8
+	Workers int `yaml:"workers,omitempty"`
+	db      *DB
+	log     string
+	client  *http.Client
+	queue   chan *delivery
+	mutex   sync.Mutex
+	// waiting are the deliveries waiting to be retried
+	waiting []*delivery
+	// subs are the subscription of each channel, kept when stopped for the channels in keep
+	subs map[string]*subscription
+	keep map[string]bool
+	// prev are the webhooks being taken over
+	prev *Webhooks
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Webhook is the target of a channel's notifications
+type Webhook struct {
+	// URLs to post the notifications to
+	URLs []string `yaml:"urls,omitempty"`
+	// Function returning the urls, called with the channel & payload
+	Function string `yaml:"function,omitempty"`
+	// Secret overrides the secret for this channel
+	Secret string `yaml:"secret,omitempty"`
+}
+
+// Delivery statuses recorded in the webhook log & outbox table
+const (
+	deliveryPending   = "pending"
+	deliveryRetrying  = "retrying"
+	deliveryDelivered = "delivered"
+	deliveryDead      = "dead"
+)
+
+// delivery is a notification being delivered to a url
+type delivery struct {
+	id       int64
+	logId    int64
+	channel  string
+	url      string
+	payload  string
+	secret   string
+	attempts int
+	// backoff is the delay before the next retry & due its time
+	backoff time.Duration
+	due     time.Time
+}
+
+// loadWebhooks checks the webhooks config & attaches its database
+func (c *OpenAPI) loadWebhooks() error {
+	w := c.Webhooks
+	if w == nil {
+		return nil
+	}
+
+	if len(w.Channels) == 0 {
+		return errors.New("webhooks: no channels defined")
+	}
+	for channel, h := range w.Channels {
+		if h == nil || (len(h.URLs) == 0) == (h.Function == "") {
+			return fmt.Errorf("webhooks: %s requires one of urls or function", channel)
+		}
+	}
+
+	if w.Retries == 0 {
+		w.Retries = 5
+	}
+	if w.Backoff <= 0 {
+		w.Backoff = 1
+	}
+	if w.MaxBackoff <= 0 {
+		w.MaxBackoff = 300
+	}
+	if w.Timeout <= 0 {
+		w.Timeout = 10
+	}
+	if w.Buffer <= 0 {
+		w.Buffer = 1024
+	}
+	if w.Workers <= 0 {
+		w.Workers = 8
+	}
+	if w.Log != "" {
+		w.log = quoteQualified(w.Log)
+	}
+
+	db, err := c.namedDB(w.Database)
+	if err != nil {
+		return fmt.Errorf("webhooks: %s", err.Error())
+	}
+	w.db = db
+
+	return nil
+}
+
+// ReuseWebhooks takes over the subscriptions & deliveries of a previous api's webhooks when the config is reloaded,
+// so notifications received or waiting to be delivered whilst reloading are not lost.
+// This must be called before prev is stopped.
+func (c *OpenAPI) ReuseWebhooks(prev *OpenAPI) {
+	w, pw := c.Webhooks, prev.Webhooks
+	if w == nil || pw == nil || pw.done == nil {
+		return
+	}
+
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+
+	// Subscriptions can only be kept if they are to the same database
+	pw.keep = make(map[string]bool)
+	if w.db == pw.db {
+		for channel := range w.Channels {
+			if _, ok := pw.Channels[channel]; ok {
+				pw.keep[channel] = true
+			}
+		}
+	}
+	w.prev = pw
+}
+
+// start subscribes to the channels & starts the workers
+func (w *Webhooks) start() {
+	w.client = &http.Client{Timeout: time.Duration(w.Timeout) * time.Second}
+	w.queue = make(chan *delivery, w.Buffer)
+	w.subs = make(map[string]*subscription)
+	w.done = make(chan struct{})
+
+	// Resume the deliveries of the previous config, or those left in the log when we last stopped
+	var pending []*delivery
+	if pw := w.prev; pw != nil {
+		pw.mutex.Lock()
+		for channel := range pw.keep {
+			w.subs[channel] = pw.subs[channel]
+		}
+		pending = pw.pending()
+		pw.mutex.Unlock()
+		w.prev = nil
+	} else {
+		pending = w.resume()
+	}
+	w.waiting = pending
+
+	for i := 0; i < w.Workers; i++ {
+		w.wg.Add(1)
+		go w.worker()
+	}
+
+	w.wg.Add(1)
+	go w.schedule()
+
+	for channel, h := range w.Channels {
+		w.wg.Add(1)
+		go w.listen(channel, h, w.subs[channel])
+	}
+
+	log.Printf("Webhooks: delivering %d channels, %d deliveries pending", len(w.Channels), len(pending))
+}
+
+// stop stops delivering, waiting for any requests in progress
+func (w *Webhooks) stop() {
+	if w.done != nil {
+		close(w.done)
+		w.wg.Wait()
+		w.done = nil
+	}
+}
+
+// pending returns the deliveries not yet made once stopped
+func (w *Webhooks) pending() []*delivery {
+	pending := w.waiting
+	for {
+		select {
+		case d := <-w.queue:
+			pending = append(pending, d)
+		default:
+			return pending
+		}
+	}
+}
+
+// resume returns the deliveries left pending or retrying in the log
+func (w *Webhooks) resume() []*delivery {
+	if w.log == "" {
+		return nil
+	}
+
+	rows, err := w.db.Query(
+		"SELECT id, channel, url, COALESCE(payload, ''), attempts FROM "+w.log+
+			" WHERE status IN ($1, $2) ORDER BY id",
+		deliveryPending, deliveryRetrying,
+	)
+	if err != nil {
+		log.Printf("Webhooks: %s: %s", w.Log, err.Error())
+		return nil
+	}
+	defer rows.Close()
+
+	var pending []*delivery
+	for rows.Next() {
+		d := &delivery{}
+		err = rows.Scan(&d.logId, &d.channel, &d.url, &d.payload, &d.attempts)
+		if err != nil {
+			log.Printf("Webhooks: %s: %s", w.Log, err.Error())
+			return pending
+		}
+
+		h, ok := w.Channels[d.channel]
+		if !ok {
+			w.record(d, deliveryDead, 0, errors.New("channel no longer has a webhook"))
+			continue
+		}
+		d.secret = w.secret(h)
+		pending = append(pending, d)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Webhooks: %s: %s", w.Log, err.Error())
+	}
+	return pending
+}
+
+// listen queues the notifications of a channel until stopped
+func (w *Webhooks) listen(channel string, h *Webhook, s *subscription) {
+	defer w.wg.Done()
+
+	n := w.db.notifier()
+	for {
+		if s == nil {
+			s, _ = n.subscribe([]string{channel}, w.Buffer, 0)
+		}
+
+		w.mutex.Lock()
+		w.subs[channel] = s
+		w.mutex.Unlock()
+
+		dropped := false
+		for !dropped {
+			select {
+			case <-w.done:
+				w.mutex.Lock()
+				keep := w.keep[channel]
+				w.mutex.Unlock()
+				if !keep {
+					n.unsubscribe(s)
+				}
+				return
+
+			case <-s.dropped:
+				log.Printf("Webhooks: %s: more than %d notifications queued, some have been lost", channel, w.Buffer)
+				dropped = true
+				s = nil
+
+			case ev := <-s.events:
+				w.notify(h, ev)
+			}
+		}
+	}
+}
+
+// notify queues a delivery of a notification to each of its urls
+func (w *Webhooks) notify(h *Webhook, ev notification) {
+	urls, err := w.targets(h, ev)
+	if err != nil {
+		log.Printf("Webhooks: %s: %s", ev.channel, err.Error())
+		return
+	}
+
+	for _, url := range urls {
+		d := &delivery{id: ev.id, channel: ev.channel, url: url, payload: ev.payload, secret: w.secret(h)}
+
+		if w.log != "" {
+			err = w.db.QueryRow(
+				"INSERT INTO "+w.log+" (channel, url, payload, status) VALUES ($1, $2, $3, $4) RETURNING id",
+				d.channel, d.url, d.payload, deliveryPending,
+			).Scan(&d.logId)
+			if err != nil {
+				log.Printf("Webhooks: %s: %s", w.Log, err.Error())
+			}
+		}
+
+		// Blocks whilst the workers are busy so the subscription's buffer takes up the slack
+		select {
+		case w.queue <- d:
+		case <-w.done:
+			w.mutex.Lock()
+			w.waiting = append(w.waiting, d)
+			w.mutex.Unlock()
+		}
+	}
+}
+
+// secret returns the secret signing the deliveries of a webhook
+func (w *Webhooks) secret(h *Webhook) string {
+	if h.Secret != "" {
+		return h.Secret
+	}
+	return w.Secret
+}
+
+// targets returns the urls a notification is delivered to
+func (w *Webhooks) targets(h *Webhook, ev notification) ([]string, error) {
+	if h.Function == "" {
+		return h.URLs, nil
+	}
+
+	rows, err := w.db.Query("SELECT * FROM "+h.Function+"($1, $2)", ev.channel, ev.payload)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var urls []string
+	for rows.Next() {
+		var url sql.NullString
+		err = rows.Scan(&url)
+		if err != nil {
+			return nil, err
+		}
+		if url.Valid && url.String != "" {
+			urls = append(urls, url.String)
+		}
+	}
+	return urls, rows.Err()
+}
+
+// worker makes deliveries until stopped
+func (w *Webhooks) worker() {
+	defer w.wg.Done()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case d := <-w.queue:
+			w.deliver(d)
+		}
+	}
+}
+
+// schedule queues the deliveries waiting to be retried once they are due
+func (w *Webhooks) schedule() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		w.mutex.Lock()
+		waiting := w.waiting[:0]
+		for _, d := range w.waiting {
+			if d.due.After(now) {
+				waiting = append(waiting, d)
+				continue
+			}
+			select {
+			case w.queue <- d:
+			default:
+				// The queue is full so try again next time
+				waiting = append(waiting, d)
+			}
+		}
+		w.waiting = waiting
+		w.mutex.Unlock()
+	}
+}
+
+// deliver makes an attempt at a delivery, scheduling a retry if it fails
+func (w *Webhooks) deliver(d *delivery) {
+	d.attempts++
+
+	// Not cancelled when stopped as the attempt is bounded by the client's timeout
+	status, err := postDelivery(context.Background(), w.client, d)
+
+	switch {
+	case err == nil:
+		w.record(d, deliveryDelivered, status, nil)
+		return
+
+	case d.attempts > w.Retries || (status >= 400 && status < 500 && status != 408 && status != 429):
+		log.Printf("Webhooks: %s %s: dead after %d attempts: %s", d.channel, d.url, d.attempts, err.Error())
+		w.record(d, deliveryDead, status, err)
+		return
+	}
+
+	w.record(d, deliveryRetrying, status, err)
+
+	if d.backoff == 0 {
+		d.backoff = time.Duration(w.Backoff) * time.Second
+	} else {
+		d.backoff *= 2
+	}
+	if max := time.Duration(w.MaxBackoff) * time.Second; d.backoff > max {
+		d.backoff = max
+	}
+	d.due = time.Now().Add(d.backoff)
+
+	w.mutex.Lock()
+	w.waiting = append(w.waiting, d)
+	w.mutex.Unlock()
+}
+
+// postDelivery posts the payload of a delivery, signed if it has a secret, returning the response status
+func postDelivery(ctx context.Context, client *http.Client, d *delivery) (int, error) {
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader([]byte(d.payload)))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+
+	contentType := "text/plain; charset=utf-8"
+	if json.Valid([]byte(d.payload)) {
+		contentType = "application/json"
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "dbrest")
+	if d.id != 0 {
+		// Deliveries resumed from the log no longer have the notification's id
+		req.Header.Set("X-Webhook-Id", strconv.FormatInt(d.id, 10))
+	}
+	req.Header.Set("X-Webhook-Channel", d.channel)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	if d.secret != "" {
+		req.Header.Set("X-Webhook-Signature", "sha256="+webhookSignature(d.secret, timestamp, d.payload))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("%s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookSignature returns the hex HMAC-SHA256 of the timestamp & payload
+func webhookSignature(secret, timestamp, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = io.WriteString(mac, timestamp+"."+payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// record updates the log with the outcome of an attempt
+func (w *Webhooks) record(d *delivery, status string, responseStatus int, err error) {
+	if d.logId == 0 {
+		return
+	}
+
+	var rs sql.NullInt64
+	if responseStatus > 0 {
+		rs = sql.NullInt64{Int64: int64(responseStatus), Valid: true}
+	}
+	var msg sql.NullString
+	if err != nil {
+		msg = sql.NullString{String: err.Error(), Valid: true}
+	}
+
+	_, err = w.db.Exec(
+		"UPDATE "+w.log+" SET status = $2, attempts = $3, response_status = $4, error = $5, updated = now() WHERE id = $1",
+		d.logId, status, d.attempts, rs, msg,
+	)
+	if err != nil {
+		log.Printf("Webhooks: %s: %s", w.Log, err.Error())
+	}
+}
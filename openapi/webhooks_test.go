@@ -0,0 +1,225 @@
+package openapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookStandIn is a local endpoint responding with the next of its statuses, the last being repeated
+type webhookStandIn struct {
+	mutex    sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+	received chan struct{}
+}
+
+func newWebhookStandIn(statuses ...int) (*webhookStandIn, *httptest.Server) {
+	s := &webhookStandIn{statuses: statuses, received: make(chan struct{}, 100)}
+	return s, httptest.NewServer(s)
+}
+
+func (s *webhookStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	s.mutex.Lock()
+	status := s.statuses[0]
+	if len(s.statuses) > 1 {
+		s.statuses = s.statuses[1:]
+	}
+	s.requests = append(s.requests, r)
+	s.bodies = append(s.bodies, string(body))
+	s.mutex.Unlock()
+
+	w.WriteHeader(status)
+	s.received <- struct{}{}
+}
+
+func (s *webhookStandIn) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.requests)
+}
+
+func testWebhooks(retries int) *Webhooks {
+	return &Webhooks{
+		Retries:    retries,
+		Backoff:    1,
+		MaxBackoff: 3,
+		client:     &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func TestPostDeliverySigned(t *testing.T) {
+	s, srv := newWebhookStandIn(204)
+	defer srv.Close()
+
+	d := &delivery{id: 42, channel: "orders", url: srv.URL, payload: `{"id":1}`, secret: "s3cret"}
+	status, err := postDelivery(context.Background(), srv.Client(), d)
+	if err != nil || status != 204 {
+		t.Fatalf("got %d %v", status, err)
+	}
+
+	r := s.requests[0]
+	if r.Method != "POST" || s.bodies[0] != d.payload {
+		t.Errorf("got %s %q", r.Method, s.bodies[0])
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	if id, ch := r.Header.Get("X-Webhook-Id"), r.Header.Get("X-Webhook-Channel"); id != "42" || ch != "orders" {
+		t.Errorf("X-Webhook-Id %q X-Webhook-Channel %q", id, ch)
+	}
+
+	// The receiver verifies the HMAC of the timestamp, a "." then the body
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(r.Header.Get("X-Webhook-Timestamp") + "." + s.bodies[0]))
+	if sig, want := r.Header.Get("X-Webhook-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); sig != want {
+		t.Errorf("X-Webhook-Signature %q, want %q", sig, want)
+	}
+}
+
+func TestPostDeliveryUnsigned(t *testing.T) {
+	s, srv := newWebhookStandIn(200)
+	defer srv.Close()
+
+	d := &delivery{channel: "orders", url: srv.URL, payload: "not json"}
+	if _, err := postDelivery(context.Background(), srv.Client(), d); err != nil {
+		t.Fatal(err)
+	}
+
+	r := s.requests[0]
+	if sig := r.Header.Get("X-Webhook-Signature"); sig != "" {
+		t.Errorf("unexpected signature %q", sig)
+	}
+	if id := r.Header.Get("X-Webhook-Id"); id != "" {
+		t.Errorf("unexpected id %q", id)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type %q", ct)
+	}
+}
+
+func TestDeliverRetriesWithBackoff(t *testing.T) {
+	s, srv := newWebhookStandIn(500)
+	defer srv.Close()
+
+	w := testWebhooks(3)
+	d := &delivery{channel: "orders", url: srv.URL, payload: "{}"}
+
+	// Each failure doubles the backoff up to MaxBackoff
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		start := time.Now()
+		w.deliver(d)
+		if len(w.waiting) != 1 || w.waiting[0] != d {
+			t.Fatalf("attempt %d: not waiting to be retried", i+1)
+		}
+		if d.backoff != want {
+			t.Errorf("attempt %d: backoff %s, want %s", i+1, d.backoff, want)
+		}
+		if d.due.Before(start.Add(want)) {
+			t.Errorf("attempt %d: due %s, before the backoff", i+1, d.due)
+		}
+		w.waiting = nil
+	}
+
+	// Dead once Retries is exceeded
+	w.deliver(d)
+	if len(w.waiting) != 0 {
+		t.Error("retried after the last attempt")
+	}
+	if d.attempts != 4 || s.count() != 4 {
+		t.Errorf("%d attempts, %d requests", d.attempts, s.count())
+	}
+}
+
+func TestDeliverStatuses(t *testing.T) {
+	tests := []struct {
+		status int
+		retry  bool
+	}{
+		{status: 200},
+		{status: 202},
+		{status: 400},
+		{status: 404},
+		{status: 408, retry: true},
+		{status: 429, retry: true},
+		{status: 500, retry: true},
+		{status: 503, retry: true},
+	}
+
+	for _, test := range tests {
+		_, srv := newWebhookStandIn(test.status)
+
+		w := testWebhooks(5)
+		d := &delivery{channel: "orders", url: srv.URL, payload: "{}"}
+		w.deliver(d)
+		if retry := len(w.waiting) > 0; retry != test.retry {
+			t.Errorf("%d: retry %v, want %v", test.status, retry, test.retry)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestWebhookWorkersRetryUntilDelivered(t *testing.T) {
+	s, srv := newWebhookStandIn(503, 200)
+	defer srv.Close()
+
+	w := testWebhooks(5)
+	w.Workers = 2
+	w.queue = make(chan *delivery, 10)
+	w.done = make(chan struct{})
+	for i := 0; i < w.Workers; i++ {
+		w.wg.Add(1)
+		go w.worker()
+	}
+	w.wg.Add(1)
+	go w.schedule()
+
+	w.queue <- &delivery{channel: "orders", url: srv.URL, payload: "{}"}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-s.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d requests received", s.count())
+		}
+	}
+
+	w.stop()
+	if n := len(w.pending()); n != 0 {
+		t.Errorf("%d deliveries pending once delivered", n)
+	}
+}
+
+func TestWebhookStopKeepsPending(t *testing.T) {
+	s, srv := newWebhookStandIn(500)
+	defer srv.Close()
+
+	w := testWebhooks(5)
+	w.Backoff = 60
+	w.queue = make(chan *delivery, 10)
+	w.done = make(chan struct{})
+	w.wg.Add(1)
+	go w.worker()
+
+	d := &delivery{channel: "orders", url: srv.URL, payload: "{}"}
+	w.queue <- d
+	<-s.received
+
+	// The retry is handed over by pending rather than lost
+	w.stop()
+	pending := w.pending()
+	if len(pending) != 1 || pending[0] != d {
+		t.Errorf("pending %v", pending)
+	}
+}
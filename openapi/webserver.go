@@ -5,4 +5,6 @@ type Webserver struct {
 	Port int `yaml:"port"`
 	// ExposeOpenAPI contains the path to the static directory containing swagger-ui
 	ExposeOpenAPI string `yaml:"exposeOpenAPI"`
+	// TLS if present enables https on the webserver
+	TLS *TLS `yaml:"tls,omitempty"`
 }
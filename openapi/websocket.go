@@ -0,0 +1,435 @@
+package openapi
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/peter-mount/golib/rest"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket lets clients subscribe to notification channels and send messages to a function over a WebSocket.
+//
+// Clients send json objects with an action:
+//
+// {"action":"subscribe","channel":"trains"} subscribes to a channel which must match one of Channels.
+//
+// {"action":"unsubscribe","channel":"trains"} unsubscribes from a channel.
+//
+// {"action":"send","id":1,"data":{...}} calls Function with the handler's parameters followed by data, the result
+// being returned as {"type":"reply","id":1,"data":...}.
+//
+// Notifications are sent as {"type":"notification","channel":"trains","id":123,"payload":...}. Errors are sent as
+// {"type":"error","id":1,"message":"..."}.
+//
+// The upgrade request is handled like any other, so its parameters are validated and if the handler has a function
+// then it's called with them to authorise the connection as with Events. Channels with parameters require either
+// that function or Allow.
+//
+// Messages sent are called in order, off the connection so a long call doesn't stop pings being answered. A client
+// with more than 16 messages waiting for a call gets an error for each further message.
+//
+// Clients that do not answer a ping before the next one is due are disconnected.
+type WebSocket struct {
+	// Channels are the channels clients may subscribe to. They may contain path parameters, e.g. train_{id},
+	// and patterns, e.g. train_*
+	Channels []string `yaml:"channels,omitempty"`
+	// Allow is a regular expression the value of each parameter in Channels must match, e.g. [0-9]+
+	Allow string `yaml:"allow,omitempty"`
+	// Function is called with the data of each message sent by the client
+	Function string `yaml:"function,omitempty"`
+	// Buffer is the number of notifications queued per client before it's disconnected, defaults to 64
+	Buffer int `yaml:"buffer,omitempty"`
+	// MaxMessageSize is the maximum size of a message from the client in bytes, defaults to 64KB
+	MaxMessageSize int64 `yaml:"maxMessageSize,omitempty"`
+	// Ping is the interval in seconds between pings to keep the connection open, defaults to 30
+	Ping   int `yaml:"ping,omitempty"`
+	sql    string
+	events *Events
+}
+
+// wsWriteTimeout is the time allowed to write a message to the client
+const wsWriteTimeout = 10 * time.Second
+
+// wsCallQueue is the number of sent messages queued per client waiting to be called
+const wsCallQueue = 16
+
+// wsUpgrader performs the opening handshake. Any origin is accepted as with the CORS config of the server.
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin: func(*http.Request) bool {
+		return true
+	},
+}
+
+// wsMessage is a message from the client
+type wsMessage struct {
+	Action  string          `json:"action"`
+	Channel string          `json:"channel,omitempty"`
+	Id      interface{}     `json:"id,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// wsFrame is a message to the client
+type wsFrame struct {
+	Type    string      `json:"type"`
+	Channel string      `json:"channel,omitempty"`
+	Id      interface{} `json:"id,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	Message string      `json:"message,omitempty"`
+}
+
+// wsClient is a connected client
+type wsClient struct {
+	m          *Method
+	conn       *websocket.Conn
+	args       []interface{}
+	allowed    []string
+	mutex      sync.Mutex
+	writeMutex sync.Mutex
+	subs       map[string]*subscription
+	calls      chan wsMessage
+	done       chan struct{}
+}
+
+// compileWebSocket prepares a WebSocket handler
+func (m *Method) compileWebSocket(params []string) error {
+	ws := m.Handler.WebSocket
+
+	if len(ws.Channels) == 0 && ws.Function == "" {
+		return fmt.Errorf("websocket requires channels or a function")
+	}
+	if ws.Buffer <= 0 {
+		ws.Buffer = 64
+	}
+	if ws.MaxMessageSize <= 0 {
+		ws.MaxMessageSize = 64 * 1024
+	}
+	if ws.Ping <= 0 {
+		ws.Ping = 30
+	}
+
+	ws.events = &Events{Channels: ws.Channels, Allow: ws.Allow}
+	err := ws.events.compileAllow(m.Handler.Function)
+	if err != nil {
+		return err
+	}
+
+	if ws.Function != "" {
+		ws.sql = "SELECT " + ws.Function + "(" + strings.Join(append(params, fmt.Sprintf("$%d", len(params)+1)), ",") + ")"
+	}
+
+	m.compileAuthorise(params)
+	return nil
+}
+
+// webSocketHandler upgrades the connection then serves the client until it disconnects
+func (m *Method) webSocketHandler(r *rest.Rest) error {
+	ws := m.Handler.WebSocket
+
+	args, err := m.extractArgs(r)
+	if err != nil {
+		return err
+	}
+
+	// The allowed channels with any parameters replaced
+	allowed, err := ws.events.channels(r)
+	if err != nil {
+		return err
+	}
+
+	err = m.authorise(r, args)
+	if err != nil {
+		return err
+	}
+
+	w, ok := responseWriter(r)
+	if !ok {
+		return errors.New("websocket: response does not support hijacking")
+	}
+
+	// On failure the upgrader has already responded
+	conn, err := wsUpgrader.Upgrade(w, r.Request(), nil)
+	if err != nil {
+		return err
+	}
+
+	c := &wsClient{
+		m:       m,
+		conn:    conn,
+		args:    args,
+		allowed: allowed,
+		subs:    make(map[string]*subscription),
+		calls:   make(chan wsMessage, wsCallQueue),
+		done:    make(chan struct{}),
+	}
+	c.serve()
+
+	return nil
+}
+
+// serve reads messages until the client disconnects
+func (c *wsClient) serve() {
+	defer c.close()
+
+	ws := c.m.Handler.WebSocket
+
+	// The client must answer each ping before the next is due
+	pongWait := 2 * time.Duration(ws.Ping) * time.Second
+	c.conn.SetReadLimit(ws.MaxMessageSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	go c.ping()
+	go c.caller()
+
+	for {
+		mt, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				log.Println("WebSocket:", err)
+			}
+			return
+		}
+
+		if mt != websocket.TextMessage {
+			c.closeWith(websocket.CloseUnsupportedData, "binary not supported")
+			return
+		}
+
+		var msg wsMessage
+		if json.Unmarshal(data, &msg) != nil {
+			c.send(wsFrame{Type: "error", Message: "invalid message"})
+			continue
+		}
+
+		switch msg.Action {
+		case "subscribe":
+			c.subscribe(msg)
+		case "unsubscribe":
+			c.unsubscribe(msg)
+		case "send":
+			select {
+			case c.calls <- msg:
+			default:
+				c.send(wsFrame{Type: "error", Id: msg.Id, Message: "too many messages"})
+			}
+		default:
+			c.send(wsFrame{Type: "error", Id: msg.Id, Message: "unknown action"})
+		}
+	}
+}
+
+// close unsubscribes from everything & closes the connection
+func (c *wsClient) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	select {
+	case <-c.done:
+		return
+	default:
+		close(c.done)
+	}
+
+	// Only if subscribed as getting the notifier would start listening
+	if len(c.subs) > 0 {
+		n := c.m.Handler.DB.notifier()
+		for _, s := range c.subs {
+			n.unsubscribe(s)
+		}
+	}
+	c.subs = nil
+
+	_ = c.conn.Close()
+}
+
+// closeWith sends a close message then closes the connection
+func (c *wsClient) closeWith(code int, reason string) {
+	_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteTimeout))
+	c.close()
+}
+
+func (c *wsClient) ping() {
+	ticker := time.NewTicker(time.Duration(c.m.Handler.WebSocket.Ping) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)) != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+func (c *wsClient) send(f wsFrame) {
+	b, err := json.Marshal(f)
+	if err == nil {
+		// Only one message may be written at a time
+		c.writeMutex.Lock()
+		_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		err = c.conn.WriteMessage(websocket.TextMessage, b)
+		c.writeMutex.Unlock()
+	}
+	if err != nil {
+		c.close()
+	}
+}
+
+func (c *wsClient) isAllowed(channel string) bool {
+	for _, pattern := range c.allowed {
+		if ok, _ := path.Match(pattern, channel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *wsClient) subscribe(msg wsMessage) {
+	if msg.Channel == "" || len(msg.Channel) > 63 || !c.isAllowed(msg.Channel) {
+		c.send(wsFrame{Type: "error", Id: msg.Id, Channel: msg.Channel, Message: "channel not allowed"})
+		return
+	}
+
+	c.mutex.Lock()
+	_, exists := c.subs[msg.Channel]
+	closed := c.subs == nil
+	c.mutex.Unlock()
+	if closed {
+		return
+	}
+
+	if !exists {
+		n := c.m.Handler.DB.notifier()
+		s, _ := n.subscribe([]string{msg.Channel}, c.m.Handler.WebSocket.Buffer, 0)
+
+		c.mutex.Lock()
+		if c.subs == nil {
+			// Closed whilst subscribing
+			c.mutex.Unlock()
+			n.unsubscribe(s)
+			return
+		}
+		c.subs[msg.Channel] = s
+		c.mutex.Unlock()
+
+		go c.relay(s)
+	}
+
+	c.send(wsFrame{Type: "subscribed", Id: msg.Id, Channel: msg.Channel})
+}
+
+func (c *wsClient) unsubscribe(msg wsMessage) {
+	c.mutex.Lock()
+	s, exists := c.subs[msg.Channel]
+	if exists {
+		delete(c.subs, msg.Channel)
+	}
+	c.mutex.Unlock()
+
+	if exists {
+		c.m.Handler.DB.notifier().unsubscribe(s)
+		close(s.events)
+	}
+
+	c.send(wsFrame{Type: "unsubscribed", Id: msg.Id, Channel: msg.Channel})
+}
+
+// relay sends the notifications of a subscription to the client
+func (c *wsClient) relay(s *subscription) {
+	for {
+		select {
+		case <-c.done:
+			return
+
+		case <-s.dropped:
+			// Backpressure, the client has fallen too far behind
+			c.closeWith(websocket.CloseTryAgainLater, "too slow")
+			return
+
+		case ev, ok := <-s.events:
+			if !ok {
+				// Unsubscribed
+				return
+			}
+
+			var payload interface{} = ev.payload
+			if json.Valid([]byte(ev.payload)) {
+				payload = json.RawMessage(ev.payload)
+			}
+			c.send(wsFrame{Type: "notification", Channel: ev.channel, Id: ev.id, Payload: payload})
+		}
+	}
+}
+
+// caller calls the function with each message sent in turn
+func (c *wsClient) caller() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.calls:
+			c.dispatch(msg)
+		}
+	}
+}
+
+// dispatch calls the function with a message
+func (c *wsClient) dispatch(msg wsMessage) {
+	ws := c.m.Handler.WebSocket
+	if ws.sql == "" {
+		c.send(wsFrame{Type: "error", Id: msg.Id, Message: "send not supported"})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if c.m.Handler.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(c.m.Handler.Timeout)*time.Second)
+	}
+	defer cancel()
+
+	// Abandon the call if the client disconnects
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	args := append(append([]interface{}{}, c.args...), string(msg.Data))
+
+	var result sql.NullString
+	err := c.m.Handler.DB.Run(ctx, c.m.Handler.txOptions, func(q Queryer) error {
+		return q.QueryRowContext(ctx, ws.sql, args...).Scan(&result)
+	})
+	if err != nil {
+		log.Println("WebSocket:", err)
+		c.send(wsFrame{Type: "error", Id: msg.Id, Message: WrapContextError(ctx, err).Error()})
+		return
+	}
+
+	var data interface{}
+	if result.Valid {
+		data = result.String
+		if json.Valid([]byte(result.String)) {
+			data = json.RawMessage(result.String)
+		}
+	}
+	c.send(wsFrame{Type: "reply", Id: msg.Id, Data: data})
+}
@@ -0,0 +1,245 @@
+package dbrest
+
+import (
+	"github.com/lib/pq"
+	"github.com/peter-mount/postgresql-rest/openapi"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// How long to wait before closing a database pool no longer in use, so requests accepted by the previous router
+// can complete
+const dbCloseDelay = 30 * time.Second
+
+// reloader triggers a reload of the config on SIGHUP, when notified the routes in the database have changed or, if
+// enabled, when any of the config files change
+type reloader struct {
+	app      *DBRest
+	signals  chan os.Signal
+	done     chan interface{}
+	modTimes map[string]time.Time
+	// listener for route changes
+	listener *pq.Listener
+	notify   <-chan *pq.Notification
+	listenOn string
+}
+
+func newReloader(app *DBRest, watch int) *reloader {
+	r := &reloader{
+		app:     app,
+		signals: make(chan os.Signal, 1),
+		done:    make(chan interface{}),
+	}
+
+	signal.Notify(r.signals, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if watch > 0 {
+		r.modTimes = r.fileModTimes()
+		ticker := time.NewTicker(time.Duration(watch) * time.Second)
+		tick = ticker.C
+		go func() {
+			<-r.done
+			ticker.Stop()
+		}()
+	}
+
+	r.listen()
+
+	go func() {
+		for {
+			select {
+			case <-r.done:
+				r.unlisten()
+				return
+
+			case <-r.notify:
+				r.debounce()
+				log.Println("Routes changed, reloading")
+				r.reload()
+
+			case <-r.signals:
+				log.Println("SIGHUP received, reloading config")
+				r.reload()
+
+			case <-tick:
+				if r.changed() {
+					log.Println("Config changed, reloading")
+					r.reload()
+				}
+			}
+		}
+	}()
+
+	return r
+}
+
+func (r *reloader) stop() {
+	signal.Stop(r.signals)
+	close(r.done)
+}
+
+func (r *reloader) reload() {
+	err := r.app.Reload()
+	if err != nil {
+		log.Println("Reload failed, keeping existing config:", err)
+	}
+	if r.modTimes != nil {
+		r.modTimes = r.fileModTimes()
+	}
+	r.listen()
+}
+
+// listen listens for notifications that the routes in the database have changed, restarting the listener if the
+// config has changed
+func (r *reloader) listen() {
+	r.app.mutex.Lock()
+	routes := r.app.config.Routes
+	r.app.mutex.Unlock()
+
+	listenOn := ""
+	if routes != nil && routes.Channel != "" && routes.DB() != nil {
+		listenOn = routes.DB().PostgresUri + "|" + routes.Channel
+	}
+
+	if listenOn == r.listenOn {
+		return
+	}
+
+	r.unlisten()
+	if listenOn == "" {
+		return
+	}
+
+	listener := pq.NewListener(routes.DB().PostgresUri, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("Routes listener:", err)
+		}
+	})
+
+	err := listener.Listen(routes.Channel)
+	if err != nil {
+		// Keep going, the listener will reconnect
+		log.Println("Routes listener:", err)
+	}
+
+	r.listener = listener
+	r.notify = listener.Notify
+	r.listenOn = listenOn
+	log.Println("Listening for route changes on", routes.Channel)
+}
+
+func (r *reloader) unlisten() {
+	if r.listener != nil {
+		_ = r.listener.Close()
+		r.listener = nil
+		r.notify = nil
+		r.listenOn = ""
+	}
+}
+
+// debounce waits briefly then discards any further notifications so a batch of changes causes a single reload
+func (r *reloader) debounce() {
+	time.Sleep(500 * time.Millisecond)
+	for {
+		select {
+		case <-r.notify:
+		default:
+			return
+		}
+	}
+}
+
+func (r *reloader) fileModTimes() map[string]time.Time {
+	r.app.mutex.Lock()
+	files := r.app.config.Files()
+	r.app.mutex.Unlock()
+
+	modTimes := make(map[string]time.Time)
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err == nil {
+			modTimes[f] = fi.ModTime()
+		}
+	}
+	return modTimes
+}
+
+func (r *reloader) changed() bool {
+	modTimes := r.fileModTimes()
+	if len(modTimes) != len(r.modTimes) {
+		return true
+	}
+	for f, m := range modTimes {
+		if !m.Equal(r.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload reloads the config and replaces the current router only if the new config loads and compiles.
+// On failure the existing router and database pools remain in use.
+//
+// Note changes to the webserver section require a restart to take effect.
+func (a *DBRest) Reload() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	config := openapi.NewOpenAPI()
+	err := config.Unmarshal(a.filename)
+	if err != nil {
+		return err
+	}
+
+	config.ReuseDatabases(a.config)
+
+	// Ensure the webserver config stays the same
+	config.Webserver = a.config.Webserver
+
+	router, err := a.buildRouter(config)
+	if err != nil {
+		closeDatabases(config.UsedDatabases(), a.config.UsedDatabases(), 0)
+		return err
+	}
+
+	config.ReuseJobs(a.config)
+	config.ReuseWebhooks(a.config)
+	config.ReusePollers(a.config)
+	a.server.SetRouter(router)
+
+	a.config.StopBackground()
+	config.StartBackground(a.cron)
+
+	closeDatabases(a.config.UsedDatabases(), config.UsedDatabases(), dbCloseDelay)
+	a.config = config
+
+	log.Println("Config reloaded")
+	return nil
+}
+
+// closeDatabases closes any database in dbs not present in keep after a delay
+func closeDatabases(dbs, keep []*openapi.DB, delay time.Duration) {
+	inUse := make(map[*openapi.DB]interface{})
+	for _, d := range keep {
+		inUse[d] = nil
+	}
+
+	var unused []*openapi.DB
+	for _, d := range dbs {
+		if _, ok := inUse[d]; !ok {
+			unused = append(unused, d)
+		}
+	}
+
+	if len(unused) > 0 {
+		time.AfterFunc(delay, func() {
+			for _, d := range unused {
+				d.Stop()
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package dbrest
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/gorilla/handlers"
+	"github.com/gorilla/mux"
+	"github.com/peter-mount/golib/kernel"
+	"github.com/peter-mount/postgresql-rest/openapi"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Server is the http server exposing the api.
+// We use this rather than rest.Server as we need control over TLS, but it accepts the same flags & environment
+// variables. The tls section of the config takes precedence over -rest-cert & -rest-key.
+type Server struct {
+	// Config is the webserver config, nil for defaults
+	Config     *openapi.Webserver
+	router     atomic.Value
+	server     *http.Server
+	logConsole *bool
+	port       *int
+	protocol   *string
+	certFile   *string
+	keyFile    *string
+}
+
+func (s *Server) Name() string {
+	return "DBRest Server"
+}
+
+func (s *Server) Init(k *kernel.Kernel) error {
+	s.logConsole = flag.Bool("rest-log", false, "Log requests to console")
+	s.protocol = flag.String("rest-protocol", "", "Protocol to use: http|https|h2|h2c")
+	s.port = flag.Int("rest-port", 0, "Port to use for http, overrides the config")
+	s.certFile = flag.String("rest-cert", "", "TLS Certificate File")
+	s.keyFile = flag.String("rest-key", "", "TLS Key File")
+	return nil
+}
+
+func (s *Server) PostInit() error {
+	// Set port, protocol & certificates from the environment if not on the command line
+	if *s.port < 1 || *s.port > 65534 {
+		p, err := strconv.Atoi(os.Getenv("RESTPORT"))
+		if err == nil {
+			*s.port = p
+		}
+	}
+	if *s.protocol == "" {
+		*s.protocol = os.Getenv("RESTPROTOCOL")
+	}
+	if *s.certFile == "" {
+		*s.certFile = os.Getenv("RESTCERT")
+	}
+	if *s.keyFile == "" {
+		*s.keyFile = os.Getenv("RESTKEY")
+	}
+
+	switch *s.protocol {
+	case "", "http", "https", "h2", "h2c":
+	default:
+		return fmt.Errorf("Invalid protocol \"%s\"", *s.protocol)
+	}
+
+	s.SetRouter(s.NewRouter())
+	return nil
+}
+
+// NewRouter returns a new empty router configured for this server
+func (s *Server) NewRouter() *mux.Router {
+	router := mux.NewRouter()
+
+	if *s.logConsole {
+		router.Use(consoleLogger)
+	}
+
+	return router
+}
+
+// SetRouter replaces the router used to serve requests.
+// Requests already in progress will complete using the router that accepted them.
+func (s *Server) SetRouter(router *mux.Router) {
+	s.router.Store(router)
+}
+
+// ServeHTTP passes the request to the current router
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.Load().(*mux.Router).ServeHTTP(w, r)
+}
+
+func (s *Server) Run() error {
+	port := *s.port
+	if port < 1 && s.Config != nil {
+		port = s.Config.Port
+	}
+	if port < 1 || port > 65534 {
+		port = 8080
+	}
+
+	handler := handlers.CORS(
+		handlers.AllowedOrigins([]string{"*"}),
+		handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type"}),
+		handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}),
+	)(s)
+
+	s.server = &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: handler,
+	}
+
+	var tlsConfig *openapi.TLS
+	if s.Config != nil && s.Config.TLS != nil {
+		tlsConfig = s.Config.TLS
+	} else if *s.certFile != "" || *s.keyFile != "" {
+		tlsConfig = &openapi.TLS{CertFile: *s.certFile, KeyFile: *s.keyFile}
+	}
+
+	protocol := *s.protocol
+	if protocol == "" {
+		protocol = "http"
+		if tlsConfig != nil {
+			protocol = "h2"
+		}
+	}
+
+	switch protocol {
+	case "https", "h2":
+		if tlsConfig == nil {
+			return fmt.Errorf("protocol %s requires tls in the config or -rest-cert and -rest-key", protocol)
+		}
+		config, err := tlsConfig.Config()
+		if err != nil {
+			return err
+		}
+		s.server.TLSConfig = config
+
+		if protocol == "https" {
+			// This disables http/2 support, which the certificates config would otherwise negotiate
+			s.server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+			getConfig := config.GetConfigForClient
+			config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				c, err := getConfig(hello)
+				if err != nil {
+					return nil, err
+				}
+				c = c.Clone()
+				c.NextProtos = []string{"http/1.1"}
+				return c, nil
+			}
+		}
+
+		log.Printf("Listening on %s for %s", s.server.Addr, protocol)
+		return s.ignoreClosed(s.server.ListenAndServeTLS("", ""))
+
+	case "h2c":
+		// http/2 without TLS
+		s.server.Handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+
+	log.Printf("Listening on %s for %s", s.server.Addr, protocol)
+	return s.ignoreClosed(s.server.ListenAndServe())
+}
+
+func (s *Server) ignoreClosed(err error) error {
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) Stop() {
+	if s.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = s.server.Shutdown(ctx)
+	}
+}